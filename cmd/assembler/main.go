@@ -10,7 +10,7 @@ import (
 	"path"
 
 	"github.com/hculpan/kabbit/pkg/assembler"
-	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/cpu"
 	"github.com/spf13/cobra"
 )
 
@@ -44,17 +44,19 @@ var rootCmd = &cobra.Command{
 		}
 
 		a := assembler.NewAssembler(debug)
+		a.SetSyscalls(cpu.StandardSyscalls().Names())
 		assembledCode, err := a.AssembleFromFile(inputFile)
 		if err != nil {
 			return err
 		}
 
-		header := assembledCode.NewFileHeader()
-		ex := executable.NewExecutableFile(outputFile, header, assembledCode.Code, assembledCode.Data)
-		fmt.Printf("Writing to output file %s\n", outputFile)
-		ex.SaveFile()
+		if strip, _ := cmd.Flags().GetBool("strip"); strip {
+			assembledCode.Debug = nil
+		}
 
-		return nil
+		ex := assembledCode.NewExecutableFile(outputFile)
+		fmt.Printf("Writing to output file %s\n", outputFile)
+		return ex.SaveFile()
 	},
 	SilenceUsage: true,
 }
@@ -70,4 +72,5 @@ func Execute() {
 func init() {
 	rootCmd.Flags().StringP("output", "o", "", "Output file")
 	rootCmd.Flags().BoolP("debug", "d", false, "Generate extra debug info")
+	rootCmd.Flags().Bool("strip", false, "Leave source lines and labels out of the executable")
 }
@@ -1,30 +1,565 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
 
+	"github.com/hculpan/kabbit/pkg/actor"
+	"github.com/hculpan/kabbit/pkg/checkpoint"
 	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/disk"
 	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/machine"
 	"github.com/hculpan/kabbit/pkg/opcodes"
+	"github.com/hculpan/kabbit/pkg/replay"
+	"github.com/hculpan/kabbit/pkg/vfs"
 )
 
-func ExecuteFile(inputFile string, disassemble bool, trace bool) error {
-	ef, err := executable.NewExecutableFromFile(inputFile)
+// ExecuteOptions holds the command line settings for a single run
+type ExecuteOptions struct {
+	Disassemble bool
+	Trace       bool
+	DiskFile    string
+	DiskBlocks  int
+	RootDir     string
+	MemFS       bool
+	Network     bool
+	AnyAddress  bool
+	Allow       executable.Capabilities
+	Args        []string
+	Env         []string
+	InputFile   string
+	NoPrompt    bool
+	Limits      cpu.Limits
+	Quantum     int
+	Cores       int
+	Seed        int64
+	Parallel    bool
+	Races       bool
+	SaveOnHalt  string
+
+	CheckpointEvery int64
+	CheckpointDir   string
+	CheckpointKeep  int
+
+	// ResumeDir is the checkpoint directory the run was resumed from
+	ResumeDir string
+
+	Record string
+	Replay string
+
+	History   int
+	LastWrite string
+
+	PersistHeap string
+
+	Watch bool
+}
+
+func ExecuteFile(inputFile string, options ExecuteOptions) error {
+	return executeFile(inputFile, nil, options)
+}
+
+// RestoreFile continues a program from a saved state. The program is the
+// one recorded in the state unless programFile is given.
+func RestoreFile(stateFile string, programFile string, options ExecuteOptions) error {
+	snapshot, err := cpu.LoadSnapshot(stateFile)
+	if err != nil {
+		return err
+	}
+
+	if len(programFile) == 0 {
+		programFile = snapshot.Program
+	}
+	if len(programFile) == 0 {
+		return fmt.Errorf("%s doesn't say which program it came from, use --program", stateFile)
+	}
+
+	return executeFile(programFile, snapshot, options)
+}
+
+// ResumeFile continues a program from the newest readable checkpoint in
+// dir
+func ResumeFile(dir string, programFile string, options ExecuteOptions) error {
+	checkpoints := &checkpoint.Dir{
+		Path: dir,
+		Skipped: func(filename string, err error) {
+			fmt.Printf("Skipping checkpoint: %v\n", err)
+		},
+	}
+	if len(programFile) > 0 {
+		checkpoints.Program, _ = filepath.Abs(programFile)
+	}
+	snapshot, filename, err := checkpoints.Latest()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Resuming from '%s'\n", filename)
+
+	if len(programFile) == 0 {
+		programFile = snapshot.Program
+	}
+	if len(programFile) == 0 {
+		return fmt.Errorf("%s doesn't say which program it came from, use --program", filename)
+	}
+
+	options.ResumeDir = dir
+	return executeFile(programFile, snapshot, options)
+}
+
+// executeFile runs a program on its own, from the start or from snapshot
+func executeFile(inputFile string, snapshot *cpu.Snapshot, options ExecuteOptions) (err error) {
+	ef, err := loadProgram(inputFile, options)
+	if err != nil || options.Disassemble {
+		return err
+	}
+
+	c, err := cpu.NewLimitedCpu(ef, nil, options.Limits)
+	if err != nil {
+		return err
+	}
+	if options.Trace {
+		c.AddObserver(traceObserver{})
+	}
+	c.SetArgs(append([]string{inputFile}, options.Args...))
+
+	closeInput, err := configureInput(c, options)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+
+	if len(options.DiskFile) > 0 {
+		d, err := openDisk(options.DiskFile, options.DiskBlocks)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		c.AttachDisk(d)
+	}
+
+	fsys, err := openFileSystem(options)
+	if err != nil {
+		return err
+	}
+	configureCpu(c, fsys, options)
+
+	if snapshot != nil {
+		if err := c.Restore(snapshot); err != nil {
+			return fmt.Errorf("%s: %w", inputFile, err)
+		}
+	} else if len(options.PersistHeap) > 0 {
+		if _, err := c.LoadHeap(options.PersistHeap); err != nil {
+			return err
+		}
+	}
+	if len(options.LastWrite) > 0 {
+		addr, err := parseAddress(options.LastWrite, ef)
+		if err != nil {
+			return err
+		}
+		if options.History == 0 {
+			options.History = cpu.DefaultHistory
+		}
+		// registered first so it runs after everything else is done with
+		// the final state
+		defer func() {
+			fmt.Print(lastWriteReport(c, c.Executable().Debug, addr))
+		}()
+	}
+	c.SetHistory(options.History)
+	if options.CheckpointEvery > 0 {
+		checkpoints, err := openCheckpoints(options)
+		if err != nil {
+			return err
+		}
+		// a checkpoint that can't be written isn't worth stopping for
+		c.SetCheckpoint(options.CheckpointEvery, func(s *cpu.Snapshot) error {
+			setProgramPath(s)
+			if err := checkpoints.Save(s); err != nil {
+				fmt.Printf("Unable to write checkpoint: %v\n", err)
+			}
+			return nil
+		})
+	}
+	if len(options.Record) > 0 {
+		f, err := os.Create(options.Record)
+		if err != nil {
+			return err
+		}
+		recorder := replay.NewRecorder(f)
+		c.SetNondeterminism(recorder.Record)
+		defer func() {
+			err = errors.Join(err, recorder.Flush(), f.Close())
+		}()
+	} else if len(options.Replay) > 0 {
+		f, err := os.Open(options.Replay)
+		if err != nil {
+			return err
+		}
+		replayer, err := replay.NewReplayer(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", options.Replay, err)
+		}
+		c.SetNondeterminism(replayer.Replay)
+		defer func() {
+			if err == nil {
+				err = replayer.Check(c)
+			}
+		}()
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		if _, ok := <-interrupts; ok {
+			c.Interrupt()
+		}
+	}()
+
+	if options.Watch {
+		defer watchProgram(c, inputFile, options)()
+	}
+
+	err = c.Run()
+	if len(options.SaveOnHalt) > 0 {
+		err = errors.Join(err, saveState(c, options.SaveOnHalt, err))
+	}
+	if err == nil && len(options.PersistHeap) > 0 {
+		err = c.SaveHeap(options.PersistHeap)
+	}
+
+	var fault *cpu.Fault
+	if errors.As(err, &fault) {
+		return fmt.Errorf("%w\n%s", err, faultReport(c, c.Executable().Debug, fault))
+	}
+
+	return err
+}
+
+// ExecuteActors runs each file as an actor with its own mailbox, giving
+// them addresses in the order they're listed. Console input goes to the
+// first one.
+func ExecuteActors(files []string, options ExecuteOptions) error {
+	if len(options.DiskFile) > 0 {
+		return errors.New("--disk can't be used with --actors")
+	} else if flag := singleProgramFlag(options); len(flag) > 0 {
+		return fmt.Errorf("%s can't be used with --actors", flag)
+	}
+
+	fsys, err := openFileSystem(options)
+	if err != nil {
+		return err
+	}
+
+	system := actor.NewSystem()
+	programs := []*executable.ExecutableFile{}
+	for i, file := range files {
+		ef, err := loadProgram(file, options)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		} else if options.Disassemble {
+			continue
+		}
+		programs = append(programs, ef)
+
+		c := system.Add(ef)
+		if options.Trace {
+			c.AddObserver(traceObserver{actors: true})
+		}
+		c.SetArgs(append([]string{file}, options.Args...))
+		configureCpu(c, fsys, options)
+
+		if i == 0 {
+			closeInput, err := configureInput(c, options)
+			if err != nil {
+				return err
+			}
+			defer closeInput()
+		} else {
+			c.SetInput(strings.NewReader(""), false)
+		}
+	}
+	if options.Disassemble {
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = system.Run(ctx)
+	reports := []string{}
+	for i, ef := range programs {
+		var fault *cpu.Fault
+		if errors.As(system.Err(int32(i)), &fault) {
+			reports = append(reports, fmt.Sprintf("actor %d (%s):\n%s", i, files[i], faultReport(system.Cpu(int32(i)), ef.Debug, fault)))
+		}
+	}
+	if len(reports) > 0 {
+		return fmt.Errorf("%w\n%s", err, strings.Join(reports, "\n"))
+	}
+
+	return err
+}
+
+// ExecuteMachine runs the program on several cores sharing one heap.
+// Console input goes to core 0.
+func ExecuteMachine(inputFile string, options ExecuteOptions) error {
+	if len(options.DiskFile) > 0 {
+		return errors.New("--disk can't be used with --cores")
+	} else if flag := singleProgramFlag(options); len(flag) > 0 {
+		return fmt.Errorf("%s can't be used with --cores", flag)
+	} else if options.Races && options.Parallel {
+		return errors.New("--races can't be used with --parallel")
+	}
+
+	ef, err := loadProgram(inputFile, options)
+	if err != nil || options.Disassemble {
+		return err
+	}
+
+	fsys, err := openFileSystem(options)
 	if err != nil {
 		return err
 	}
 
-	if disassemble {
-		return disassembleFile(ef)
+	m := machine.New(ef, options.Cores)
+	m.SetSeed(options.Seed)
+	m.SetParallel(options.Parallel)
+	if options.Races {
+		m.DetectRaces()
+	}
+
+	for i, c := range m.Cores {
+		if options.Trace {
+			c.AddObserver(traceObserver{cores: true})
+		}
+		c.SetArgs(append([]string{inputFile}, options.Args...))
+		configureCpu(c, fsys, options)
+
+		if i == 0 {
+			closeInput, err := configureInput(c, options)
+			if err != nil {
+				return err
+			}
+			defer closeInput()
+		} else {
+			c.SetInput(strings.NewReader(""), false)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = m.Run(ctx)
+	if options.Races {
+		printRaces(m.Races(), ef.Debug)
+	}
+
+	var fault *cpu.Fault
+	if errors.As(err, &fault) && m.Failed() != nil {
+		return fmt.Errorf("%w\n%s", err, faultReport(m.Failed(), ef.Debug, fault))
+	}
+
+	return err
+}
+
+// saveState saves the program's state once Run has returned, by which
+// time any files or sockets it left open have been closed. Nothing is
+// saved when the program faulted, though going over a limit isn't counted
+// as a fault.
+func saveState(c *cpu.Cpu, filename string, runErr error) error {
+	var fault *cpu.Fault
+	var limitErr *cpu.LimitError
+	if errors.As(runErr, &fault) && !errors.As(runErr, &limitErr) {
+		return nil
+	}
+
+	snapshot, err := c.Snapshot()
+	if err == nil {
+		setProgramPath(snapshot)
+		err = snapshot.Save(filename)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to save state: %w", err)
+	}
+
+	fmt.Printf("State saved to '%s'\n", filename)
+	return nil
+}
+
+// openCheckpoints prepares the checkpoint directory. Checkpoints already
+// there are carried on from if the run was resumed from them, and
+// otherwise refused, since they belong to some other run.
+func openCheckpoints(options ExecuteOptions) (*checkpoint.Dir, error) {
+	checkpoints, err := checkpoint.New(options.CheckpointDir, options.CheckpointKeep)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(options.ResumeDir) > 0 && sameDir(options.ResumeDir, options.CheckpointDir) {
+		return checkpoints, checkpoints.Continue()
+	}
+
+	files, err := checkpoints.Files()
+	if err != nil {
+		return nil, err
+	} else if len(files) > 0 {
+		return nil, fmt.Errorf("'%s' already holds checkpoints, continue from them with kabv resume or remove them", options.CheckpointDir)
+	}
+
+	return checkpoints, nil
+}
+
+func sameDir(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
+
+// setProgramPath makes the program recorded in a snapshot absolute, so it
+// can be restored from another directory
+func setProgramPath(s *cpu.Snapshot) {
+	if program, err := filepath.Abs(s.Program); err == nil && len(s.Program) > 0 {
+		s.Program = program
+	}
+}
+
+// singleProgramFlag returns the first flag given that only works when a
+// single program runs on its own
+func singleProgramFlag(options ExecuteOptions) string {
+	switch {
+	case len(options.SaveOnHalt) > 0:
+		return "--save-on-halt"
+	case options.CheckpointEvery > 0:
+		return "--checkpoint-every"
+	case len(options.Record) > 0:
+		return "--record"
+	case len(options.Replay) > 0:
+		return "--replay"
+	case options.History > 0:
+		return "--history"
+	case len(options.LastWrite) > 0:
+		return "--last-write"
+	case len(options.PersistHeap) > 0:
+		return "--persist-heap"
+	case options.Watch:
+		return "--watch"
+	}
+
+	return ""
+}
+
+func printRaces(races []machine.Race, debug *executable.DebugInfo) {
+	if len(races) == 0 {
+		fmt.Println("No races found")
+		return
+	}
+
+	fmt.Printf("Found %d races:\n", len(races))
+	for _, race := range races {
+		fmt.Printf("  %s\n", race)
+		if debug == nil {
+			continue
+		}
+		for _, access := range []machine.Access{race.Current, race.Previous} {
+			if line, ok := debug.LineAt(access.IP); ok {
+				fmt.Printf("    core %d at %s:%d: %s\n", access.Core, debug.Source, line.Line, line.Text)
+			}
+		}
+	}
+}
+
+// loadProgram reads an executable, disassembling it if asked, and checks
+// that the capabilities it needs have been granted
+func loadProgram(filename string, options ExecuteOptions) (*executable.ExecutableFile, error) {
+	ef, err := executable.NewExecutableFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Disassemble {
+		return ef, disassembleFile(ef)
+	}
+
+	if !options.Allow.Has(ef.Capabilities) {
+		return nil, fmt.Errorf("program requires capabilities that weren't granted: %s (use --allow)", ef.Capabilities&^options.Allow)
+	}
+
+	// checked before any cpu allocates the heap
+	if err := options.Limits.CheckFile(ef); err != nil {
+		return nil, err
+	}
+
+	return ef, nil
+}
+
+// configureCpu applies the settings every program gets, whether it runs
+// alone or as an actor
+func configureCpu(c *cpu.Cpu, fsys vfs.FileSystem, options ExecuteOptions) {
+	c.SetEnv(options.Env)
+	c.SetLimits(options.Limits)
+	c.SetQuantum(options.Quantum)
+	if fsys != nil {
+		c.AttachFileSystem(fsys)
+	}
+	if options.Network {
+		c.EnableNetwork(!options.AnyAddress)
+	}
+}
+
+// configureInput connects the program's console input. The returned
+// function closes the input file, if one was opened.
+func configureInput(c *cpu.Cpu, options ExecuteOptions) (func(), error) {
+	if len(options.InputFile) > 0 {
+		f, err := os.Open(options.InputFile)
+		if err != nil {
+			return nil, err
+		}
+		c.SetInput(f, false)
+		return func() { f.Close() }, nil
+	} else if options.NoPrompt {
+		c.SetInput(os.Stdin, false)
+	}
+
+	return func() {}, nil
+}
+
+func openFileSystem(options ExecuteOptions) (vfs.FileSystem, error) {
+	if len(options.RootDir) > 0 {
+		fsys, err := vfs.NewDirFS(options.RootDir)
+		if err != nil {
+			return nil, err
+		}
+		return fsys, nil
+	} else if options.MemFS {
+		return vfs.NewMemFS(), nil
+	}
+
+	return nil, nil
+}
+
+// openDisk attaches an existing disk image, creating it first if it
+// doesn't exist and a block count was given
+func openDisk(filename string, blocks int) (*disk.Disk, error) {
+	if _, err := os.Stat(filename); err == nil {
+		return disk.Open(filename)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
 	}
 
-	var monitorFunc cpu.MonitorFunc = nil
-	if trace {
-		monitorFunc = Monitor
+	if blocks < 1 {
+		return nil, fmt.Errorf("disk image '%s' not found, use --disk-blocks to create it", filename)
 	}
-	cpu := cpu.NewCpu(ef, monitorFunc)
-	return cpu.Run()
+
+	return disk.Create(filename, blocks)
 }
 
 func decode(opcode, param int32) string {
@@ -36,10 +571,15 @@ func decode(opcode, param int32) string {
 	return fmt.Sprintf("%8s %6X", strings.ToUpper(instr.Pneumonic), param)
 }
 
-func Monitor(c *cpu.Cpu, lastError *error) {
-	if c.IsHalted() {
-		return
-	}
+// traceObserver prints each instruction before it runs, with the top of
+// the stack and the start of the heap
+type traceObserver struct {
+	cpu.BaseObserver
+	actors bool
+	cores  bool
+}
+
+func (t traceObserver) BeforeInstruction(c *cpu.Cpu, ip int, opcode int32, operand int32) {
 	stack := ""
 
 	max := 3
@@ -65,8 +605,15 @@ func Monitor(c *cpu.Cpu, lastError *error) {
 		}
 	}
 
-	fmt.Printf("  IP:%08X    %-10s    SP:%08X  Stack: [%-28s]    Mem:(%s)\n",
-		c.InstructionPointer, decode(c.Code[c.InstructionPointer], c.Code[c.InstructionPointer+1]), c.StackPointer, stack, mem)
+	actor := ""
+	if t.actors {
+		actor = fmt.Sprintf("A%-3d ", c.Address())
+	} else if t.cores {
+		actor = fmt.Sprintf("C%-3d ", c.CoreID())
+	}
+
+	fmt.Printf("  %sT%-3d IP:%08X    %-10s    SP:%08X  Stack: [%-28s]    Mem:(%s)\n",
+		actor, c.ThreadID(), ip, decode(opcode, operand), c.StackPointer, stack, mem)
 }
 
 func disassembleFile(ef *executable.ExecutableFile) error {
@@ -76,6 +623,7 @@ func disassembleFile(ef *executable.ExecutableFile) error {
 	fmt.Printf("  Code Size : %10d [%08X]\n", ef.Header.CodeSize, ef.Header.CodeSize)
 	fmt.Printf("  Stack Size: %10d [%08X]\n", ef.Header.StackSize, ef.Header.StackSize)
 	fmt.Printf("  Heap Size : %10d [%08X]\n", ef.Header.HeapSize, ef.Header.HeapSize)
+	fmt.Printf("  Requires  : %s\n", ef.Capabilities)
 
 	fmt.Println()
 
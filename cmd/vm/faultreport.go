@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// faultStackDepth is how many stack values a fault report shows
+const faultStackDepth = 8
+
+// faultReport describes where a fault happened, using the program's
+// debug info when it has some
+func faultReport(c *cpu.Cpu, debug *executable.DebugInfo, fault *cpu.Fault) string {
+	var report strings.Builder
+
+	if debug == nil {
+		report.WriteString("  no debug info, assemble without --strip to see source lines\n")
+	} else {
+		if line, ok := debug.LineAt(fault.IP); ok {
+			fmt.Fprintf(&report, "  at %s:%d: %s\n", debug.Source, line.Line, line.Text)
+		}
+		if label, ok := debug.CodeLabelAt(fault.IP); ok {
+			fmt.Fprintf(&report, "  in %s\n", offsetName(label, int32(fault.IP)))
+		}
+	}
+
+	report.WriteString("  stack (top first):")
+	sp := fault.SP
+	if sp > len(c.Stack) {
+		sp = len(c.Stack)
+	}
+	if sp == 0 {
+		report.WriteString(" empty")
+	}
+	for i := sp - 1; i >= 0 && i >= sp-faultStackDepth; i-- {
+		fmt.Fprintf(&report, " %d", c.Stack[i])
+	}
+	if sp > faultStackDepth {
+		fmt.Fprintf(&report, " ... (%d more)", sp-faultStackDepth)
+	}
+	report.WriteString("\n")
+
+	for _, addr := range faultAddresses(c, fault) {
+		if addr < 0 || int(addr) >= len(c.Heap) {
+			fmt.Fprintf(&report, "  heap %d: outside the heap of %d words\n", addr, len(c.Heap))
+			continue
+		}
+
+		fmt.Fprintf(&report, "  heap %s = %d\n", heapName(debug, addr), c.Heap[addr])
+	}
+
+	return strings.TrimRight(report.String(), "\n")
+}
+
+// heapName names a heap cell by its label, if it has one
+func heapName(debug *executable.DebugInfo, addr int32) string {
+	if addr == 0 {
+		return "index"
+	} else if debug != nil {
+		if label, ok := debug.DataLabelAt(addr); ok {
+			return fmt.Sprintf("%s (%d)", offsetName(label, addr), addr)
+		}
+	}
+
+	return fmt.Sprintf("%d", addr)
+}
+
+// faultAddresses returns the heap cells the faulting instruction uses
+func faultAddresses(c *cpu.Cpu, fault *cpu.Fault) []int32 {
+	switch fault.Opcode {
+	case opcodes.LD, opcodes.ST, opcodes.MINC, opcodes.MDEC, opcodes.OUTS, opcodes.PRINTF,
+		opcodes.READBLK, opcodes.WRITEBLK, opcodes.READ, opcodes.WRITE, opcodes.SEND, opcodes.RECV:
+		return []int32{fault.Operand}
+	case opcodes.LDI, opcodes.STI:
+		return []int32{0, fault.Operand + c.Heap[0]}
+	case opcodes.INCI, opcodes.DECI:
+		return []int32{0}
+	}
+
+	return nil
+}
+
+func offsetName(label executable.Label, addr int32) string {
+	if addr == label.Address {
+		return label.Name
+	}
+	return fmt.Sprintf("%s+%d", label.Name, addr-label.Address)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// parseAddress reads a heap address given as a number or a data label
+func parseAddress(s string, ef *executable.ExecutableFile) (int32, error) {
+	if n, err := strconv.ParseInt(s, 0, 32); err == nil {
+		if n < 0 || n >= int64(ef.Header.HeapSize) {
+			return 0, fmt.Errorf("address %d is outside the heap of %d words", n, ef.Header.HeapSize)
+		}
+		return int32(n), nil
+	}
+
+	if ef.Debug != nil {
+		if label, ok := ef.Debug.DataLabel(s); ok {
+			return label.Address, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no data label '%s' (labels need debug info)", s)
+}
+
+// lastWriteReport steps the cpu back to the last instruction that wrote
+// to addr and describes it
+func lastWriteReport(c *cpu.Cpu, debug *executable.DebugInfo, addr int32) string {
+	var report strings.Builder
+
+	value := c.Heap[addr]
+	kept := c.History()
+	steps, err := c.ReverseToWrite(addr)
+	if err != nil {
+		fmt.Fprintf(&report, "No write to heap %s in the last %d instructions\n", heapName(debug, addr), kept)
+		return report.String()
+	}
+
+	ip := c.InstructionPointer
+	fmt.Fprintf(&report, "Last write to heap %s was instruction %d, %d before the end: %d became %d\n",
+		heapName(debug, addr), c.Instructions()+1, steps, c.Heap[addr], value)
+	line, ok := executable.LineInfo{}, false
+	if debug != nil {
+		line, ok = debug.LineAt(ip)
+	}
+	if ok {
+		fmt.Fprintf(&report, "  at IP 0x%04X, %s:%d: %s\n", ip, debug.Source, line.Line, line.Text)
+	} else {
+		fmt.Fprintf(&report, "  at IP 0x%04X: %s\n", ip, strings.Join(strings.Fields(decode(c.Code[ip], c.Code[ip+1])), " "))
+	}
+
+	return report.String()
+}
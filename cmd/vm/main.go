@@ -4,7 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/hculpan/kabbit/pkg/checkpoint"
+	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/executable"
 	"github.com/spf13/cobra"
 )
 
@@ -15,23 +19,198 @@ func main() {
 }
 
 var rootCmd = &cobra.Command{
-	Use:   "kabv <input file>",
+	Use:   "kabv <input file> [-- program arguments]",
 	Short: "Executes programs in the Kabbit VM",
 	Long:  `Executes programs in the Kabbit VM`,
+	Args:  cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if len(args) != 1 {
+		programArgs := []string{}
+		if dash := cmd.ArgsLenAtDash(); dash > -1 {
+			programArgs = args[dash:]
+			args = args[:dash]
+		}
+		actors, _ := cmd.Flags().GetStringSlice("actors")
+		if len(actors) > 0 && len(args) > 0 {
+			return errors.New("give the programs to run either with --actors or as the input file, not both")
+		} else if len(actors) == 0 && len(args) != 1 {
 			return errors.New("missing required parameter: input file")
 		}
 
-		disassemble, _ = cmd.Flags().GetBool("disassemble")
-		trace, _ := cmd.Flags().GetBool("trace")
+		options, err := readOptions(cmd, programArgs)
+		if err != nil {
+			return err
+		} else if options.Cores > 1 && len(actors) > 0 {
+			return errors.New("--cores can't be used with --actors")
+		}
+
+		if len(actors) > 0 {
+			return ExecuteActors(actors, options)
+		} else if options.Cores > 1 {
+			return ExecuteMachine(args[0], options)
+		}
+		return ExecuteFile(args[0], options)
+	},
+	SilenceUsage: true,
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <state file> [-- program arguments]",
+	Short: "Continues a program from a state saved with --save-on-halt",
+	Long: `Continues a program from a state saved with --save-on-halt. The program
+is loaded from where it was when the state was saved, unless --program
+says otherwise, and must be the same one.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		programArgs := []string{}
+		if dash := cmd.ArgsLenAtDash(); dash > -1 {
+			programArgs = args[dash:]
+			args = args[:dash]
+		}
+		if len(args) != 1 {
+			return errors.New("missing required parameter: state file")
+		}
+
+		options, err := readOptions(cmd, programArgs)
+		if err != nil {
+			return err
+		}
+		program, _ := cmd.Flags().GetString("program")
 
-		input := args[0]
-		return ExecuteFile(input, disassemble, trace)
+		return RestoreFile(args[0], program, options)
 	},
 	SilenceUsage: true,
 }
 
+var resumeCmd = &cobra.Command{
+	Use:   "resume <checkpoint directory> [-- program arguments]",
+	Short: "Continues a program from its newest checkpoint",
+	Long: `Continues a program from the newest checkpoint in a directory written
+with --checkpoint-every, skipping any that are damaged. Checkpoints carry
+on going to the same directory unless --checkpoint-dir says otherwise.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		programArgs := []string{}
+		if dash := cmd.ArgsLenAtDash(); dash > -1 {
+			programArgs = args[dash:]
+			args = args[:dash]
+		}
+		if len(args) != 1 {
+			return errors.New("missing required parameter: checkpoint directory")
+		}
+
+		options, err := readOptions(cmd, programArgs)
+		if err != nil {
+			return err
+		}
+		if !cmd.Flags().Changed("checkpoint-dir") {
+			options.CheckpointDir = args[0]
+		}
+		program, _ := cmd.Flags().GetString("program")
+
+		return ResumeFile(args[0], program, options)
+	},
+	SilenceUsage: true,
+}
+
+// readOptions reads the flags shared by running a program and restoring
+// one
+func readOptions(cmd *cobra.Command, programArgs []string) (ExecuteOptions, error) {
+	disassemble, _ = cmd.Flags().GetBool("disassemble")
+	trace, _ := cmd.Flags().GetBool("trace")
+	diskFile, _ := cmd.Flags().GetString("disk")
+	diskBlocks, _ := cmd.Flags().GetInt("disk-blocks")
+	rootDir, _ := cmd.Flags().GetString("root")
+	memFS, _ := cmd.Flags().GetBool("memfs")
+	if len(rootDir) > 0 && memFS {
+		return ExecuteOptions{}, errors.New("--root and --memfs can't be used together")
+	}
+	network, _ := cmd.Flags().GetBool("net")
+	loopbackOnly, _ := cmd.Flags().GetBool("loopback-only")
+	allowNames, _ := cmd.Flags().GetStringSlice("allow")
+	allow, err := executable.ParseCapabilities(allowNames)
+	if err != nil {
+		return ExecuteOptions{}, err
+	}
+	envNames, _ := cmd.Flags().GetStringArray("env")
+	inputFile, _ := cmd.Flags().GetString("input")
+	noPrompt, _ := cmd.Flags().GetBool("no-prompt")
+	maxInstructions, _ := cmd.Flags().GetInt64("max-instructions")
+	timeLimit, _ := cmd.Flags().GetDuration("time-limit")
+	maxStack, _ := cmd.Flags().GetInt("max-stack")
+	maxHeap, _ := cmd.Flags().GetInt("max-heap")
+	gas, _ := cmd.Flags().GetInt64("gas")
+	quantum, _ := cmd.Flags().GetInt("quantum")
+	cores, _ := cmd.Flags().GetInt("cores")
+	seed, _ := cmd.Flags().GetInt64("seed")
+	parallel, _ := cmd.Flags().GetBool("parallel")
+	races, _ := cmd.Flags().GetBool("races")
+	saveOnHalt, _ := cmd.Flags().GetString("save-on-halt")
+	checkpointEvery, _ := cmd.Flags().GetInt64("checkpoint-every")
+	checkpointDir, _ := cmd.Flags().GetString("checkpoint-dir")
+	checkpointKeep, _ := cmd.Flags().GetInt("checkpoint-keep")
+	record, _ := cmd.Flags().GetString("record")
+	replay, _ := cmd.Flags().GetString("replay")
+	history, _ := cmd.Flags().GetInt("history")
+	lastWrite, _ := cmd.Flags().GetString("last-write")
+	persistHeap, _ := cmd.Flags().GetString("persist-heap")
+	watch, _ := cmd.Flags().GetBool("watch")
+	if len(record) > 0 && len(replay) > 0 {
+		return ExecuteOptions{}, errors.New("--record and --replay can't be used together")
+	}
+
+	return ExecuteOptions{
+		Args:        programArgs,
+		Env:         selectEnv(envNames),
+		InputFile:   inputFile,
+		NoPrompt:    noPrompt,
+		Disassemble: disassemble,
+		Trace:       trace,
+		DiskFile:    diskFile,
+		DiskBlocks:  diskBlocks,
+		RootDir:     rootDir,
+		MemFS:       memFS,
+		Network:     network,
+		AnyAddress:  !loopbackOnly,
+		Allow:       allow,
+		Quantum:     quantum,
+		Cores:       cores,
+		Seed:        seed,
+		Parallel:    parallel,
+		Races:       races,
+		Limits: cpu.Limits{
+			MaxInstructions: maxInstructions,
+			MaxDuration:     timeLimit,
+			MaxStackDepth:   maxStack,
+			MaxHeapSize:     maxHeap,
+			Gas:             gas,
+		},
+		SaveOnHalt:      saveOnHalt,
+		CheckpointEvery: checkpointEvery,
+		CheckpointDir:   checkpointDir,
+		CheckpointKeep:  checkpointKeep,
+		Record:          record,
+		Replay:          replay,
+		History:         history,
+		LastWrite:       lastWrite,
+		PersistHeap:     persistHeap,
+		Watch:           watch,
+	}, nil
+}
+
+// selectEnv builds the environment given to the program. A plain name
+// copies that variable from kabv's own environment, if set, and NAME=value
+// sets it directly.
+func selectEnv(names []string) []string {
+	result := []string{}
+	for _, name := range names {
+		if strings.Contains(name, "=") {
+			result = append(result, name)
+		} else if v, ok := os.LookupEnv(name); ok {
+			result = append(result, name+"="+v)
+		}
+	}
+
+	return result
+}
+
 func Execute() {
 	fmt.Println("Kabbit Virtual Machine v0.1.0")
 	err := rootCmd.Execute()
@@ -42,6 +221,51 @@ func Execute() {
 
 func init() {
 	// rootCmd.Flags().StringP("output", "o", "", "Output file")
-	rootCmd.Flags().BoolP("disassemble", "d", disassemble, "Output disassembly")
-	rootCmd.Flags().BoolP("trace", "t", false, "Output trace information")
+	addRunFlags(rootCmd)
+	rootCmd.Flags().StringSlice("actors", []string{}, "Run these programs together as actors that can message each other")
+	rootCmd.Flags().Int("cores", 1, "Run the program on this many cores sharing one heap")
+	rootCmd.Flags().Int64("seed", 1, "Seed for the order multiple cores are interleaved in")
+	rootCmd.Flags().Bool("parallel", false, "Run each core on its own goroutine instead of interleaving them from the seed")
+	rootCmd.Flags().Bool("races", false, "Report conflicting heap accesses between cores")
+
+	addRunFlags(restoreCmd)
+	restoreCmd.Flags().String("program", "", "The program's executable, if it has moved since the state was saved")
+	rootCmd.AddCommand(restoreCmd)
+
+	addRunFlags(resumeCmd)
+	resumeCmd.Flags().String("program", "", "The program's executable, if it has moved since the checkpoint was written")
+	rootCmd.AddCommand(resumeCmd)
+}
+
+// addRunFlags adds the flags for running a program, whether from the
+// start or from a saved state
+func addRunFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("disassemble", "d", disassemble, "Output disassembly")
+	cmd.Flags().BoolP("trace", "t", false, "Output trace information")
+	cmd.Flags().String("disk", "", "Attach a disk image file")
+	cmd.Flags().Int("disk-blocks", 0, "Number of blocks when creating a new disk image")
+	cmd.Flags().String("root", "", "Give the program file access confined to this directory")
+	cmd.Flags().Bool("memfs", false, "Give the program an empty in-memory file system")
+	cmd.Flags().Bool("net", false, "Give the program access to TCP sockets")
+	cmd.Flags().Bool("loopback-only", true, "Restrict sockets to loopback addresses")
+	cmd.Flags().String("input", "", "Read input from a file instead of the console")
+	cmd.Flags().Bool("no-prompt", false, "Read input without prompting, as with --input")
+	cmd.Flags().StringArray("env", []string{}, "Expose an environment variable to the program, as NAME or NAME=value")
+	cmd.Flags().StringSlice("allow", []string{"console"}, "Capabilities the program may use: console, fs, net, time, sys, disk, msg")
+	cmd.Flags().Int64("max-instructions", 0, "Stop the program after this many instructions")
+	cmd.Flags().Duration("time-limit", 0, "Stop the program after this much wall time, e.g. 5s")
+	cmd.Flags().Int("max-stack", 0, "Limit the stack to this many words")
+	cmd.Flags().Int("max-heap", 0, "Refuse programs whose heap is larger than this many words")
+	cmd.Flags().Int64("gas", 0, "Gas budget; each instruction is charged by its cost")
+	cmd.Flags().Int("quantum", cpu.DefaultQuantum, "Instructions a thread runs before the next one gets a turn, 0 to switch only on yield")
+	cmd.Flags().String("save-on-halt", "", "Save the program's state to this file when it halts or is interrupted")
+	cmd.Flags().Int64("checkpoint-every", 0, "Save the program's state every this many instructions")
+	cmd.Flags().String("checkpoint-dir", "checkpoints", "Directory to write checkpoints to")
+	cmd.Flags().Int("checkpoint-keep", checkpoint.DefaultKeep, "Number of checkpoints to keep")
+	cmd.Flags().String("record", "", "Log every input, time and random value the program is given to this file")
+	cmd.Flags().String("replay", "", "Give the program the values logged by --record instead of reading them")
+	cmd.Flags().Int("history", 0, "Keep a record of this many instructions so they can be stepped back")
+	cmd.Flags().String("persist-heap", "", "Load the heap from this file, if it exists, and save it back when the program halts")
+	cmd.Flags().String("last-write", "", "After the run, step back to the last write to this heap address or data label and show it")
+	cmd.Flags().Bool("watch", false, "Reload the program into the running cpu whenever its file changes")
 }
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSelectEnv(t *testing.T) {
+	t.Setenv("KABV_TEST_HOME", "/home/kabbit")
+
+	env := selectEnv([]string{"KABV_TEST_HOME", "KABV_TEST_UNSET", "MODE=fast", "EMPTY="})
+	expected := []string{"KABV_TEST_HOME=/home/kabbit", "MODE=fast", "EMPTY="}
+	if !slices.Equal(env, expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+}
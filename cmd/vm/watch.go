@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+)
+
+// watchInterval is how often --watch checks the program file
+const watchInterval = 500 * time.Millisecond
+
+// watchProgram reloads the program into c whenever filename changes,
+// until the returned function is called. A build that can't be loaded,
+// or can't take over from the running one, is reported and the old code
+// keeps running.
+func watchProgram(c *cpu.Cpu, filename string, options ExecuteOptions) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	modified := func() time.Time {
+		if info, err := os.Stat(filename); err == nil {
+			return info.ModTime()
+		}
+		return time.Time{}
+	}
+
+	go func() {
+		defer close(finished)
+
+		last := modified()
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			current := modified()
+			if current.IsZero() || current.Equal(last) {
+				continue
+			}
+			last = current
+
+			ef, err := loadProgram(filename, options)
+			if err != nil {
+				fmt.Printf("Unable to reload '%s': %v\n", filename, err)
+				continue
+			}
+			if c.Pause() != nil {
+				// the program has finished
+				continue
+			}
+			err = c.Reload(ef)
+			c.Resume()
+			if err != nil {
+				fmt.Printf("Unable to reload '%s': %v\n", filename, err)
+			} else {
+				fmt.Printf("Reloaded '%s'\n", filename)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
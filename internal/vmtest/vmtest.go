@@ -0,0 +1,42 @@
+// Package vmtest holds the fixtures shared by tests that assemble small
+// programs and run them on a cpu.
+package vmtest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hculpan/kabbit/pkg/assembler"
+	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// Assemble builds source into an executable, failing the test if it
+// doesn't assemble. syscalls, if not nil, makes its names known to the
+// assembler.
+func Assemble(t testing.TB, source string, syscalls *cpu.Syscalls) *executable.ExecutableFile {
+	t.Helper()
+
+	a := assembler.NewAssembler(false)
+	if syscalls != nil {
+		a.SetSyscalls(syscalls.Names())
+	}
+	code, err := a.Assemble(source)
+	if err != nil {
+		t.Fatalf("unable to assemble: %v", err)
+	}
+	return code.NewExecutableFile("test.kbx")
+}
+
+// NewCpu creates a cpu for file that reads input without prompting and
+// writes to the returned buffer
+func NewCpu(t testing.TB, file *executable.ExecutableFile, input string) (*cpu.Cpu, *bytes.Buffer) {
+	t.Helper()
+
+	c := cpu.NewCpu(file, nil)
+	c.SetInput(strings.NewReader(input), false)
+	out := new(bytes.Buffer)
+	c.SetOutput(out)
+	return c, out
+}
@@ -0,0 +1,222 @@
+// Package kabbit runs Kabbit programs from Go. It wraps the assembler,
+// executable and cpu packages so that embedding the VM doesn't mean
+// wiring them together by hand, and it never touches the process's
+// stdin or stdout unless asked to.
+//
+//	prog, err := kabbit.LoadFile("count.kbx")
+//	if err != nil {
+//		return err
+//	}
+//	result, err := prog.Run(kabbit.WithInput(strings.NewReader("3\n")))
+//	fmt.Print(string(result.Output))
+package kabbit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/assembler"
+	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// Program is a loaded executable, ready to run any number of times
+type Program struct {
+	file *executable.ExecutableFile
+}
+
+// ExitStatus says how a run ended
+type ExitStatus int
+
+const (
+	// Halted means the program reached HALT
+	Halted ExitStatus = iota
+	// Faulted means the VM stopped the program with an error
+	Faulted
+	// Interrupted means the run was cut short from outside, e.g. by
+	// WithTimeout, WithContext or Cpu.Stop
+	Interrupted
+	// LimitExceeded means the program went over one of the limits set
+	// with WithLimits
+	LimitExceeded
+)
+
+func (s ExitStatus) String() string {
+	switch s {
+	case Halted:
+		return "halted"
+	case Faulted:
+		return "faulted"
+	case Interrupted:
+		return "interrupted"
+	case LimitExceeded:
+		return "limit exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+// Result describes a finished run
+type Result struct {
+	Status ExitStatus
+
+	// Output holds everything the program printed, unless WithOutput sent
+	// it somewhere else
+	Output []byte
+
+	Instructions int64
+	GasUsed      int64
+	Duration     time.Duration
+
+	// Stack and Heap are copies of the cpu's memory when the run ended
+	Stack []int32
+	Heap  []int32
+}
+
+// Load parses an executable held in memory
+func Load(data []byte) (*Program, error) {
+	ef, err := executable.NewExecutableFromBytes(data, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Program{file: ef}, nil
+}
+
+// LoadFile reads an executable (.kbx) file
+func LoadFile(filename string) (*Program, error) {
+	ef, err := executable.NewExecutableFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Program{file: ef}, nil
+}
+
+// LoadSource assembles a program from source. WithSyscalls makes custom
+// syscall names available to it; the other options are ignored.
+func LoadSource(source string, options ...Option) (*Program, error) {
+	cfg := newConfig(options)
+
+	a := assembler.NewAssembler(false)
+	a.SetSyscalls(cfg.syscalls.Names())
+	code, err := a.Assemble(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Program{file: code.NewExecutableFile("")}, nil
+}
+
+// LoadSourceFile assembles a program from a source (.kba) file
+func LoadSourceFile(filename string, options ...Option) (*Program, error) {
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadSource(string(source), options...)
+}
+
+// Executable returns the underlying executable, e.g. to save it
+func (p *Program) Executable() *executable.ExecutableFile {
+	return p.file
+}
+
+// Capabilities returns what the program declared it needs
+func (p *Program) Capabilities() executable.Capabilities {
+	return p.file.Capabilities
+}
+
+// Run executes the program on a fresh cpu. The error is non-nil whenever
+// the program didn't reach HALT, and the result is filled in either way
+// unless the program couldn't be started.
+func (p *Program) Run(options ...Option) (*Result, error) {
+	result, _, err := p.run(nil, options)
+	return result, err
+}
+
+// run is Run, reusing stack for the cpu if it's big enough. It returns
+// the cpu's stack so it can be reused again.
+func (p *Program) run(stack []int32, options []Option) (*Result, []int32, error) {
+	cfg := newConfig(options)
+
+	if !cfg.allow.Has(p.file.Capabilities) {
+		return nil, stack, fmt.Errorf("program requires capabilities that weren't allowed: %s", p.file.Capabilities&^cfg.allow)
+	}
+
+	c, err := cpu.NewLimitedCpu(p.file, stack, cfg.limits)
+	if err != nil {
+		return nil, stack, err
+	}
+	c.Monitor = cfg.monitor
+	for _, o := range cfg.observers {
+		c.AddObserver(o)
+	}
+	result := &Result{}
+
+	output := cfg.output
+	if output == nil {
+		output = new(bytes.Buffer)
+	}
+	input := cfg.input
+	if input == nil {
+		input = strings.NewReader("")
+	}
+	c.SetInput(input, false)
+	c.SetOutput(output)
+	c.SetArgs(cfg.args)
+	c.SetEnv(cfg.env)
+	c.SetSyscalls(cfg.syscalls)
+	if cfg.disk != nil {
+		c.AttachDisk(cfg.disk)
+	}
+	if cfg.fileSystem != nil {
+		c.AttachFileSystem(cfg.fileSystem)
+	}
+	if cfg.network {
+		c.EnableNetwork(cfg.loopbackOnly)
+	}
+
+	if cfg.timeout > 0 {
+		timer := time.AfterFunc(cfg.timeout, c.Interrupt)
+		defer timer.Stop()
+	}
+
+	if cfg.onStart != nil {
+		cfg.onStart(c)
+	}
+
+	start := time.Now()
+	if cfg.ctx != nil {
+		err = c.RunContext(cfg.ctx)
+	} else {
+		err = c.Run()
+	}
+	result.Duration = time.Since(start)
+	result.Instructions = c.Instructions()
+	result.GasUsed = c.GasUsed()
+	result.Stack = append([]int32{}, c.Stack[:c.StackPointer]...)
+	result.Heap = append([]int32{}, c.Heap...)
+	if buf, ok := output.(*bytes.Buffer); ok && cfg.output == nil {
+		result.Output = buf.Bytes()
+	}
+
+	var limitErr *cpu.LimitError
+	switch {
+	case err == nil:
+		result.Status = Halted
+	case errors.As(err, &limitErr):
+		result.Status = LimitExceeded
+	case errors.Is(err, cpu.ErrInterrupted):
+		result.Status = Interrupted
+	default:
+		result.Status = Faulted
+	}
+
+	return result, c.Stack, err
+}
@@ -0,0 +1,191 @@
+package kabbit
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+const countSource = `
+limit:  wd  0
+count:  wd  0
+        in
+        st  limit
+loop:
+        ld  count
+        ld  limit
+        iseq
+        jif done
+        minc count
+        ld  count
+        out
+        jmp loop
+done:
+        halt
+`
+
+func TestRunCapturesOutput(t *testing.T) {
+	prog, err := LoadSource(countSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the data section must not carry over from one run to the next
+	for i := 0; i < 2; i++ {
+		result, err := prog.Run(WithInput(strings.NewReader("3\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != Halted {
+			t.Fatalf("expected halted, got %s", result.Status)
+		}
+		if string(result.Output) != "1\n2\n3\n" {
+			t.Fatalf("run %d: unexpected output %q", i, string(result.Output))
+		}
+		if result.Heap[2] != 3 {
+			t.Fatalf("expected count of 3, got %d", result.Heap[2])
+		}
+	}
+}
+
+func TestLoadFromBytes(t *testing.T) {
+	prog, err := LoadSource(countSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := prog.Executable().Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	result, err := loaded.Run(WithInput(strings.NewReader("2")), WithOutput(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "1\n2\n" || result.Output != nil {
+		t.Fatalf("expected output only in writer, got %q and %q", out.String(), string(result.Output))
+	}
+}
+
+func TestHostileExecutable(t *testing.T) {
+	prog, err := LoadSource(countSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := prog.Executable().Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// a section claiming far more bytes than the file holds
+	truncated := append(append([]byte{}, data...), 'J', 'U', 'N', 'K', 0xFF, 0xFF, 0xFF, 0xF0, 1, 2, 3)
+	if _, err := Load(truncated); err == nil || !strings.Contains(err.Error(), "truncated section") {
+		t.Fatalf("expected truncated section error, got %v", err)
+	}
+
+	// a heap of 1G words must be refused before it's allocated
+	executable.Endian.PutUint32(data[8:12], 1<<30)
+	loaded, err := Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.Run(WithLimits(cpu.Limits{MaxHeapSize: 1024})); !errors.Is(err, cpu.ErrHeapLimit) {
+		t.Fatalf("expected heap limit error, got %v", err)
+	}
+
+	// and a stack of 4G words must only be allocated as far as the limit
+	executable.Endian.PutUint32(data[8:12], uint32(len(prog.Executable().Data)))
+	executable.Endian.PutUint32(data[4:8], 0xFFFFFFFF)
+	loaded, err = Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stack int
+	result, err := loaded.Run(WithInput(strings.NewReader("2")), WithLimits(cpu.Limits{MaxStackDepth: 64}),
+		WithStartHook(func(c *cpu.Cpu) { stack = len(c.Stack) }))
+	if err != nil || result.Status != Halted {
+		t.Fatalf("expected the program to run, got %v", err)
+	}
+	if stack != 64 {
+		t.Fatalf("expected a stack of 64 words, got %d", stack)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	prog, err := LoadSource(`
+spin:   jmp spin
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := prog.Run(WithTimeout(50 * time.Millisecond))
+	if err == nil || result.Status != Interrupted {
+		t.Fatalf("expected interrupted run, got %v", err)
+	}
+	if result.Instructions == 0 {
+		t.Fatal("expected instructions to be counted")
+	}
+}
+
+func TestPool(t *testing.T) {
+	prog, err := LoadSource(countSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	divide, err := LoadSource(`
+        push 0
+        push 1
+        div
+        halt
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewPool(4)
+	jobs := []*Job{}
+	for i := 0; i < 50; i++ {
+		jobs = append(jobs, pool.Submit(prog, WithInput(strings.NewReader("3\n"))))
+	}
+	failing := pool.Submit(divide)
+
+	for _, job := range jobs {
+		result, err := job.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result.Output) != "1\n2\n3\n" {
+			t.Fatalf("unexpected output %q", string(result.Output))
+		}
+	}
+	if _, err := failing.Wait(); err == nil {
+		t.Fatal("expected divide by zero")
+	}
+	pool.Close()
+
+	metrics := pool.Metrics()
+	if metrics.Jobs != 51 || metrics.Failed != 1 || metrics.Failures["divide by zero"] != 1 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+	if metrics.Instructions == 0 {
+		t.Fatal("expected instructions to be counted")
+	}
+	if _, err := pool.Run(prog); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("expected pool closed, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package kabbit
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/vfs"
+)
+
+// Option configures a run
+type Option func(*config)
+
+type config struct {
+	input        io.Reader
+	output       io.Writer
+	args         []string
+	env          []string
+	allow        executable.Capabilities
+	syscalls     *cpu.Syscalls
+	disk         cpu.BlockDevice
+	fileSystem   vfs.FileSystem
+	network      bool
+	loopbackOnly bool
+	timeout      time.Duration
+	limits       cpu.Limits
+	ctx          context.Context
+	monitor      cpu.MonitorFunc
+	observers    []cpu.Observer
+	onStart      func(*cpu.Cpu)
+}
+
+func newConfig(options []Option) *config {
+	result := &config{
+		allow:    executable.CapConsole,
+		syscalls: cpu.StandardSyscalls(),
+	}
+
+	for _, option := range options {
+		option(result)
+	}
+
+	return result
+}
+
+// WithInput supplies the lines read by IN. Without it, IN sees the end
+// of input straight away.
+func WithInput(r io.Reader) Option {
+	return func(c *config) {
+		c.input = r
+	}
+}
+
+// WithOutput sends the program's output to w instead of Result.Output
+func WithOutput(w io.Writer) Option {
+	return func(c *config) {
+		c.output = w
+	}
+}
+
+// WithArgs sets the values read by ARGC and ARGV
+func WithArgs(args ...string) Option {
+	return func(c *config) {
+		c.args = args
+	}
+}
+
+// WithEnv exposes environment variables, in "NAME=value" form, to ENVC
+// and ENVV
+func WithEnv(env ...string) Option {
+	return func(c *config) {
+		c.env = env
+	}
+}
+
+// WithAllow sets the capabilities a program may require. A program that
+// needs anything else won't be run. Only the console is allowed by default.
+func WithAllow(caps executable.Capabilities) Option {
+	return func(c *config) {
+		c.allow = caps
+	}
+}
+
+// WithSyscalls replaces the standard syscall table
+func WithSyscalls(syscalls *cpu.Syscalls) Option {
+	return func(c *config) {
+		c.syscalls = syscalls
+	}
+}
+
+// WithDisk attaches a block device
+func WithDisk(d cpu.BlockDevice) Option {
+	return func(c *config) {
+		c.disk = d
+	}
+}
+
+// WithFileSystem attaches a file system, e.g. vfs.NewMemFS()
+func WithFileSystem(fsys vfs.FileSystem) Option {
+	return func(c *config) {
+		c.fileSystem = fsys
+	}
+}
+
+// WithNetwork enables sockets, optionally restricted to loopback addresses
+func WithNetwork(loopbackOnly bool) Option {
+	return func(c *config) {
+		c.network = true
+		c.loopbackOnly = loopbackOnly
+	}
+}
+
+// WithTimeout interrupts the program if it runs longer than d
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// WithLimits caps the instructions, time, memory or gas the program
+// can use
+func WithLimits(limits cpu.Limits) Option {
+	return func(c *config) {
+		c.limits = limits
+	}
+}
+
+// WithObserver sends the program's events to o. It can be given more
+// than once.
+func WithObserver(o cpu.Observer) Option {
+	return func(c *config) {
+		c.observers = append(c.observers, o)
+	}
+}
+
+// WithMonitor calls fn before and after each instruction
+//
+// Deprecated: use WithObserver
+func WithMonitor(fn cpu.MonitorFunc) Option {
+	return func(c *config) {
+		c.monitor = fn
+	}
+}
+
+// WithContext stops the program when ctx is cancelled
+func WithContext(ctx context.Context) Option {
+	return func(c *config) {
+		c.ctx = ctx
+	}
+}
+
+// WithStartHook calls fn with the configured cpu just before it starts.
+// Keeping hold of the cpu allows another goroutine to Pause, Resume or
+// Stop it.
+func WithStartHook(fn func(*cpu.Cpu)) Option {
+	return func(c *config) {
+		c.onStart = fn
+	}
+}
@@ -0,0 +1,200 @@
+// Package actor runs several programs side by side in one process. Each
+// one gets a mailbox, and they talk by sending blocks of words to each
+// other's addresses with MSEND and MRECV.
+package actor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// MailboxSize is the number of messages that can be waiting for an actor
+// before sends to it fail with ErrCodeMailboxFull
+const MailboxSize = 256
+
+// System is a group of actors. Add them all before calling Run.
+type System struct {
+	mu       sync.Mutex
+	actors   []*actor
+	running  int
+	waiting  int
+	deadlock bool
+	stopping bool
+	errs     []error
+}
+
+// actor's inbox is guarded by the system's lock, so the deadlock check
+// always sees messages and waiting actors consistently
+type actor struct {
+	cpu    *cpu.Cpu
+	inbox  []cpu.Message
+	notify chan struct{}
+	done   bool
+}
+
+func NewSystem() *System {
+	return &System{}
+}
+
+// Add creates a cpu for file with the next free address, starting from 0.
+// The cpu can be given input, output, devices and limits as usual before
+// Run is called.
+func (s *System) Add(file *executable.ExecutableFile) *cpu.Cpu {
+	c := cpu.NewCpu(file, nil)
+	c.AttachMailbox(int32(len(s.actors)), s)
+	s.actors = append(s.actors, &actor{cpu: c, notify: make(chan struct{}, 1)})
+
+	return c
+}
+
+// Cpu returns the actor at address, or nil
+func (s *System) Cpu(address int32) *cpu.Cpu {
+	if address < 0 || int(address) >= len(s.actors) {
+		return nil
+	}
+
+	return s.actors[address].cpu
+}
+
+func (s *System) Len() int {
+	return len(s.actors)
+}
+
+func (s *System) Send(from int32, to int32, words []int32) int32 {
+	if to < 0 || int(to) >= len(s.actors) {
+		return cpu.ErrCodeNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.actors[to]
+	if len(a.inbox) >= MailboxSize {
+		return cpu.ErrCodeMailboxFull
+	}
+
+	a.inbox = append(a.inbox, cpu.Message{From: from, Words: words})
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+	return 0
+}
+
+func (s *System) Receive(id int32, timeout time.Duration) (cpu.Message, bool) {
+	a := s.actors[id]
+
+	s.mu.Lock()
+	if msg, ok := a.take(); ok {
+		s.mu.Unlock()
+		return msg, true
+	}
+	s.waiting++
+	s.checkDeadlock()
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-a.notify:
+	case <-timer.C:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waiting--
+	return a.take()
+}
+
+func (a *actor) take() (cpu.Message, bool) {
+	if len(a.inbox) == 0 {
+		return cpu.Message{}, false
+	}
+
+	msg := a.inbox[0]
+	a.inbox = a.inbox[1:]
+	return msg, true
+}
+
+// checkDeadlock stops every actor if all of those still running are
+// waiting on empty mailboxes, since nothing can ever arrive
+func (s *System) checkDeadlock() {
+	if s.deadlock || s.running == 0 || s.waiting < s.running {
+		return
+	}
+
+	// messages left for actors that have finished will never be read
+	for _, a := range s.actors {
+		if !a.done && len(a.inbox) > 0 {
+			return
+		}
+	}
+
+	s.deadlock = true
+	s.stopAll()
+}
+
+func (s *System) stopAll() {
+	s.stopping = true
+	for _, a := range s.actors {
+		a.cpu.Stop()
+	}
+}
+
+// Err returns the error the actor at address stopped with in the last
+// Run, or nil if it halted normally or was stopped because another failed
+func (s *System) Err(address int32) error {
+	if address < 0 || int(address) >= len(s.errs) {
+		return nil
+	}
+
+	return s.errs[address]
+}
+
+// Run starts every actor and waits for them all to finish. If one fails
+// the others are stopped, and the error names the actor that failed.
+func (s *System) Run(ctx context.Context) error {
+	s.mu.Lock()
+	s.running = len(s.actors)
+	s.deadlock, s.stopping = false, false
+	for _, a := range s.actors {
+		a.done = false
+	}
+	s.mu.Unlock()
+
+	errs := make([]error, len(s.actors))
+	s.errs = errs
+	wg := sync.WaitGroup{}
+	for i, a := range s.actors {
+		wg.Add(1)
+		go func(i int, a *actor) {
+			defer wg.Done()
+
+			err := a.cpu.RunContext(ctx)
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.running--
+			a.done = true
+			if err != nil && !(s.stopping && errors.Is(err, cpu.ErrInterrupted)) {
+				errs[i] = fmt.Errorf("actor %d: %w", i, err)
+				if !s.stopping && !errors.Is(err, cpu.ErrInterrupted) {
+					s.stopAll()
+				}
+			}
+			s.checkDeadlock()
+		}(i, a)
+	}
+	wg.Wait()
+
+	if s.deadlock {
+		return errors.Join(append([]error{fmt.Errorf("%w: every actor is waiting for a message", cpu.ErrDeadlock)}, errs...)...)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+package actor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hculpan/kabbit/internal/vmtest"
+	"github.com/hculpan/kabbit/pkg/cpu"
+)
+
+func TestPingPong(t *testing.T) {
+	ping := vmtest.Assemble(t, `
+        .requires console, msg
+value:  wd 41
+        push 1
+        push 1
+        msend value
+        pop
+        push 1
+        mrecv value
+        pop
+        pop
+        ld value
+        out
+        halt
+`, nil)
+	pong := vmtest.Assemble(t, `
+        .requires msg
+buf:    ds 4
+        push 4
+        mrecv buf
+        pop
+        ld buf
+        inc
+        st buf
+        push 1
+        msend buf
+        halt
+`, nil)
+
+	s := NewSystem()
+	out := new(bytes.Buffer)
+	s.Add(ping).SetOutput(out)
+	s.Add(pong)
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "42\n" {
+		t.Fatalf("expected 42, got %q", out.String())
+	}
+}
+
+func TestNegativeCounts(t *testing.T) {
+	program := vmtest.Assemble(t, `
+        .requires console, msg
+buf:    wd 0
+        push 1
+        push 0
+        dec
+        msend buf
+        out
+        push 0
+        dec
+        mrecv buf
+        out
+        out
+        halt
+`, nil)
+
+	s := NewSystem()
+	out := new(bytes.Buffer)
+	s.Add(program).SetOutput(out)
+
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "-4\n-4\n-4\n" {
+		t.Fatalf("expected invalid argument errors, got %q", out.String())
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	wait := vmtest.Assemble(t, `
+        .requires msg
+buf:    wd 0
+        push 1
+        mrecv buf
+        halt
+`, nil)
+
+	s := NewSystem()
+	s.Add(wait)
+	s.Add(wait)
+
+	if err := s.Run(context.Background()); !errors.Is(err, cpu.ErrDeadlock) {
+		t.Fatalf("expected deadlock, got %v", err)
+	}
+}
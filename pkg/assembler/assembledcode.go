@@ -3,8 +3,13 @@ package assembler
 import "github.com/hculpan/kabbit/pkg/executable"
 
 type AssembledCode struct {
-	Data []int32
-	Code []int32
+	Data         []int32
+	Code         []int32
+	Capabilities executable.Capabilities
+
+	// Debug maps the code back to the source. Set it to nil to leave it
+	// out of the executable.
+	Debug *executable.DebugInfo
 }
 
 func (a *AssembledCode) NewFileHeader() *executable.FileHeader {
@@ -14,3 +19,11 @@ func (a *AssembledCode) NewFileHeader() *executable.FileHeader {
 		HeapSize:  uint32(len(a.Data)),
 	}
 }
+
+// NewExecutableFile packages the assembled program, ready to be saved
+func (a *AssembledCode) NewExecutableFile(filename string) *executable.ExecutableFile {
+	result := executable.NewExecutableFile(filename, a.NewFileHeader(), a.Code, a.Data)
+	result.Capabilities = a.Capabilities
+	result.Debug = a.Debug
+	return result
+}
@@ -4,10 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Assembler struct {
 	debugInfo bool
+	syscalls  map[string]int32
 }
 
 func NewAssembler(debugInfo bool) *Assembler {
@@ -16,6 +19,12 @@ func NewAssembler(debugInfo bool) *Assembler {
 	}
 }
 
+// SetSyscalls gives the names that SYS operands can use in place of a
+// syscall number, usually from cpu.Syscalls.Names
+func (a *Assembler) SetSyscalls(names map[string]int32) {
+	a.syscalls = names
+}
+
 func (a *Assembler) Assemble(input string) (*AssembledCode, error) {
 	l := NewLexer(input)
 	nodes, err := Parse(l)
@@ -29,15 +38,19 @@ func (a *Assembler) Assemble(input string) (*AssembledCode, error) {
 		return nil, fmt.Errorf("expected program node, found %s", nodes[0].GetDescription())
 	}
 
-	code, data, err := Generate(nodes, a.debugInfo)
+	result, err := Generate(nodes, a.syscalls, a.debugInfo)
 	if err != nil {
 		return nil, err
 	}
 
-	return &AssembledCode{
-		Data: data,
-		Code: code,
-	}, nil
+	lines := strings.Split(input, "\n")
+	for i, l := range result.Debug.Lines {
+		if l.Line > 0 && int(l.Line) <= len(lines) {
+			result.Debug.Lines[i].Text = strings.TrimSpace(lines[l.Line-1])
+		}
+	}
+
+	return result, nil
 }
 
 func (a *Assembler) AssembleFromFile(inputFile string) (*AssembledCode, error) {
@@ -46,9 +59,15 @@ func (a *Assembler) AssembleFromFile(inputFile string) (*AssembledCode, error) {
 		return nil, err
 	}
 
-	fmt.Printf("Read %d bytes from file %s\n", len(fileBytes), inputFile)
+	if a.debugInfo {
+		fmt.Printf("Read %d bytes from file %s\n", len(fileBytes), inputFile)
+	}
 
-	fileString := string(fileBytes)
+	result, err := a.Assemble(string(fileBytes))
+	if err != nil {
+		return nil, err
+	}
+	result.Debug.Source = filepath.Base(inputFile)
 
-	return a.Assemble(fileString)
+	return result, nil
 }
@@ -1,6 +1,9 @@
 package assembler
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type Node interface {
 	GetLineNo() int
@@ -22,6 +25,7 @@ func (n *ProgramNode) GetDescription() string {
 type DirectiveNode struct {
 	LineNo    int
 	Directive string
+	Args      []string
 }
 
 func (n *DirectiveNode) GetLineNo() int {
@@ -29,6 +33,9 @@ func (n *DirectiveNode) GetLineNo() int {
 }
 
 func (n *DirectiveNode) GetDescription() string {
+	if len(n.Args) > 0 {
+		return fmt.Sprintf("DirectiveNode [%s  %s]", n.Directive, strings.Join(n.Args, ", "))
+	}
 	return fmt.Sprintf("DirectiveNode [%s]", n.Directive)
 }
 
@@ -3,13 +3,18 @@ package assembler
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
+	"github.com/hculpan/kabbit/pkg/executable"
 	"github.com/hculpan/kabbit/pkg/opcodes"
 )
 
-func Generate(nodes []Node, debugInfo bool) ([]int32, []int32, error) {
+func Generate(nodes []Node, syscalls map[string]int32, debugInfo bool) (*AssembledCode, error) {
 	code := []int32{}
 	data := []int32{0}
+	var capabilities executable.Capabilities = 0
+	requiresFound := false
+	debug := &executable.DebugInfo{}
 
 	if debugInfo {
 		fmt.Println("\nAST:")
@@ -18,72 +23,127 @@ func Generate(nodes []Node, debugInfo bool) ([]int32, []int32, error) {
 		}
 	}
 
-	if err := pass1(nodes); err != nil { // find labels
-		return nil, nil, err
+	symbols := NewSymbolTable()
+	if err := pass1(nodes, symbols); err != nil { // find labels
+		return nil, err
 	}
 
 	if debugInfo {
 		fmt.Println()
-		fmt.Println(DisplaySymbolTable())
+		fmt.Println(symbols.DisplaySymbolTable())
 	}
 
 	// pass 2 - generate code
-	for _, node := range nodes {
+	for idx, node := range nodes {
 		switch n := node.(type) {
+		case *LabelNode:
+			addr, _ := symbols.GetSymbolValue(n.Name)
+			debug.Labels = append(debug.Labels, executable.Label{Name: n.Name, Address: addr, Data: labelsData(nodes, idx)})
 		case *InstructionNode:
 			instr, err := opcodes.GetInstructionByPneumonic(n.Pneumonic)
 			if err != nil {
-				return nil, nil, err
+				return nil, err
 			}
+			debug.Lines = append(debug.Lines, executable.LineInfo{Address: int32(len(code)), Line: int32(n.LineNo)})
 			code = append(code, int32(instr.Opcode))
-			if instr.Param == opcodes.INT32 {
-				if v, err := getOperandValue(n.Operand, n.LineNo); err != nil {
-					return nil, nil, err
+			if instr.Opcode == opcodes.SYS {
+				if v, err := getSyscallValue(n.Operand, n.LineNo, syscalls); err != nil {
+					return nil, err
+				} else {
+					code = append(code, v)
+				}
+			} else if instr.Param == opcodes.INT32 {
+				if v, err := getOperandValue(n.Operand, n.LineNo, symbols); err != nil {
+					return nil, err
 				} else {
 					code = append(code, v)
 				}
 			} else {
 				code = append(code, 0)
 			}
+		case *DirectiveNode:
+			if strings.EqualFold(n.Directive, "requires") {
+				caps, err := executable.ParseCapabilities(n.Args)
+				if err != nil {
+					return nil, fmt.Errorf("[%d] %w", n.LineNo, err)
+				}
+				capabilities |= caps
+				requiresFound = true
+			}
 		case *DataNode:
-			if v, err := getOperandValue(n.Value, n.LineNo); err != nil {
-				return nil, nil, err
+			if n.DataType == "ws" {
+				for i := 0; i < len(n.Value); i++ {
+					data = append(data, int32(n.Value[i]))
+				}
+				data = append(data, 0)
+			} else if v, err := getOperandValue(n.Value, n.LineNo, symbols); err != nil {
+				return nil, err
+			} else if n.DataType == "ds" {
+				data = append(data, make([]int32, v)...)
 			} else {
 				data = append(data, v)
 			}
 		}
 	}
 
-	return code, data, nil
+	// programs that don't say otherwise only get the console
+	if !requiresFound {
+		capabilities = executable.CapConsole
+	}
+
+	debug.SortLabels()
+
+	return &AssembledCode{
+		Code:         code,
+		Data:         data,
+		Capabilities: capabilities,
+		Debug:        debug,
+	}, nil
 }
 
-func getOperandValue(operand string, lineNo int) (int32, error) {
+func getOperandValue(operand string, lineNo int, symbols *SymbolTable) (int32, error) {
 	if v, err := strconv.Atoi(operand); err == nil {
 		return int32(v), nil
 	}
 
 	// failed to convert, so assuming it's a symbol
-	if v, err := GetSymbolValue(operand); err == nil {
+	if v, err := symbols.GetSymbolValue(operand); err == nil {
 		return v, nil
 	}
 
 	return 0, fmt.Errorf("[%d] unknown symbol '%s'", lineNo, operand)
 }
 
-func pass1(nodes []Node) error {
+func getSyscallValue(operand string, lineNo int, syscalls map[string]int32) (int32, error) {
+	if v, err := strconv.Atoi(operand); err == nil {
+		return int32(v), nil
+	}
+
+	if v, ok := syscalls[operand]; ok {
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("[%d] unknown syscall '%s'", lineNo, operand)
+}
+
+func pass1(nodes []Node, symbols *SymbolTable) error {
 	codeLoc := 0
 	dataLoc := 1
 	for idx, node := range nodes {
 		switch n := node.(type) {
 		case *DataNode:
-			dataLoc++
+			size, err := dataSize(n)
+			if err != nil {
+				return err
+			}
+			dataLoc += size
 		case *InstructionNode:
 			codeLoc += 2
 		case *LabelNode:
 			if addr, err := findNextNode(nodes, idx, codeLoc, dataLoc); err != nil {
 				return err
-			} else {
-				AddSymbol(n.Name, int32(addr))
+			} else if err := symbols.AddSymbol(n.Name, int32(addr)); err != nil {
+				return fmt.Errorf("[%d] %w", n.LineNo, err)
 			}
 		}
 	}
@@ -91,6 +151,37 @@ func pass1(nodes []Node) error {
 	return nil
 }
 
+// dataSize returns the number of heap words a data node occupies
+func dataSize(n *DataNode) (int, error) {
+	if n.DataType == "ws" {
+		return len(n.Value) + 1, nil
+	} else if n.DataType != "ds" {
+		return 1, nil
+	}
+
+	size, err := strconv.Atoi(n.Value)
+	if err != nil || size < 1 {
+		return 0, fmt.Errorf("[%d] ds requires a positive numeric size, found '%s'", n.LineNo, n.Value)
+	}
+
+	return size, nil
+}
+
+// labelsData reports whether the label at idx names a heap location
+// rather than a code address
+func labelsData(nodes []Node, idx int) bool {
+	for i := idx + 1; i < len(nodes); i++ {
+		switch nodes[i].(type) {
+		case *DataNode:
+			return true
+		case *InstructionNode:
+			return false
+		}
+	}
+
+	return false
+}
+
 func findNextNode(nodes []Node, idx, codeLoc, dataLoc int) (int, error) {
 	for i := idx + 1; i < len(nodes); i++ {
 		switch nodes[i].(type) {
@@ -0,0 +1,51 @@
+package assembler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+func TestDebugInfo(t *testing.T) {
+	code, err := NewAssembler(false).Assemble(`count:  wd 3
+buf:    ds 2
+start:
+        push 1
+loop:   mdec count
+        jmp loop
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := code.NewExecutableFile("test.kbx").Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	ef, err := executable.NewExecutableFromBytes(buf.Bytes(), "test.kbx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ef.Debug == nil {
+		t.Fatal("expected debug info")
+	}
+
+	line, ok := ef.Debug.LineAt(2)
+	if !ok || line.Line != 5 || line.Text != "loop:   mdec count" {
+		t.Fatalf("unexpected line for IP 2: %+v", line)
+	}
+	if label, ok := ef.Debug.CodeLabelAt(4); !ok || label.Name != "loop" || label.Address != 2 {
+		t.Fatalf("unexpected code label for IP 4: %+v", label)
+	}
+	if label, ok := ef.Debug.DataLabelAt(3); !ok || label.Name != "buf" || label.Address != 2 {
+		t.Fatalf("unexpected data label for address 3: %+v", label)
+	}
+
+	code.Debug = nil
+	buf.Reset()
+	code.NewExecutableFile("test.kbx").Write(buf)
+	if ef, _ := executable.NewExecutableFromBytes(buf.Bytes(), "test.kbx"); ef.Debug != nil {
+		t.Fatal("expected stripped executable to have no debug info")
+	}
+}
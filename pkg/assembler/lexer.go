@@ -9,20 +9,24 @@ const (
 	TokenTypeLabel = iota
 	TokenTypeIdentifier
 	TokenTypeNumber
+	TokenTypeString
 	TokenTypeDirective
 	TokenTypeComment
 	TokenTypeEOL
 	TokenTypeEOF
+	TokenTypeIllegal
 )
 
 var TokenTypeNames []string = []string{
 	"label",
 	"identifier",
 	"number",
+	"string",
 	"directive",
 	"comment",
 	"EOL",
 	"EOF",
+	"illegal",
 }
 
 func getTokenTypeName(i int) string {
@@ -110,6 +114,12 @@ func (l *Lexer) NextToken() *Token {
 		l.readChar()
 	case l.ch == '.':
 		tok = newToken(TokenTypeDirective, l.readIdentifier(), l.currentLine)
+	case l.ch == '"':
+		if literal, ok := l.readString(); ok {
+			tok = newToken(TokenTypeString, literal, l.currentLine)
+		} else {
+			tok = newToken(TokenTypeIllegal, literal, l.currentLine)
+		}
 	case l.ch == ';': // line comment
 		tok = newToken(TokenTypeComment, l.readLineComment(), l.currentLine)
 	case l.ch == '/' && l.peekChar() == '*':
@@ -143,6 +153,41 @@ func (l *Lexer) readNumber() string {
 	return l.input[position:l.position]
 }
 
+// readString reads a double quoted string, returning its contents with
+// escapes decoded. It fails if the string isn't closed on the same line.
+func (l *Lexer) readString() (string, bool) {
+	result := []byte{}
+	l.readChar() // opening quote
+	for l.ch != '"' {
+		switch l.ch {
+		case 0, '\n':
+			return `"` + string(result), false
+		case '\\':
+			l.readChar()
+			switch l.ch {
+			case 'n':
+				result = append(result, '\n')
+			case 't':
+				result = append(result, '\t')
+			case 'r':
+				result = append(result, '\r')
+			case '0':
+				result = append(result, 0)
+			case '"', '\\':
+				result = append(result, l.ch)
+			default:
+				return `"` + string(result) + `\` + string(l.ch), false
+			}
+		default:
+			result = append(result, l.ch)
+		}
+		l.readChar()
+	}
+	l.readChar() // closing quote
+
+	return string(result), true
+}
+
 func (l *Lexer) readLineComment() string {
 	position := l.position
 	for l.ch != '\n' && l.ch != 0 {
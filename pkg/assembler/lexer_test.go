@@ -182,6 +182,29 @@ out:
 	validateTokens(t, tests, l)
 }
 
+func TestStringLiteral(t *testing.T) {
+	input := `
+	msg: ws "say \"hi\"\n" ; greeting
+	bad: ws "unterminated
+	`
+
+	tests := []Test{
+		{TokenTypeEOL, ""},
+		{TokenTypeLabel, "msg:"},
+		{TokenTypeIdentifier, "ws"},
+		{TokenTypeString, "say \"hi\"\n"},
+		{TokenTypeComment, "; greeting"},
+		{TokenTypeEOL, ""},
+		{TokenTypeLabel, "bad:"},
+		{TokenTypeIdentifier, "ws"},
+		{TokenTypeIllegal, "\"unterminated"},
+		{TokenTypeEOL, ""},
+	}
+
+	l := NewLexer(input)
+	validateTokens(t, tests, l)
+}
+
 func validateTokens(t *testing.T, tests []Test, l *Lexer) {
 	for i, tt := range tests {
 		tok := l.NextToken()
@@ -17,14 +17,11 @@ func Parse(l *Lexer) ([]Node, error) {
 	for currToken != nil && currToken.Type != TokenTypeEOF {
 		switch currToken.Type {
 		case TokenTypeDirective:
-			node := &DirectiveNode{
-				Directive: currToken.Literal[1:],
-				LineNo:    currToken.LineNo,
-			}
-			result = append(result, node)
-			if err := expectedToken(l, TokenTypeEOL, TokenTypeComment); err != nil {
+			node, err := parseDirective(l, currToken)
+			if err != nil {
 				return nil, err
 			}
+			result = append(result, node)
 		case TokenTypeLabel:
 			node := &LabelNode{
 				Name:   currToken.Literal[:len(currToken.Literal)-1],
@@ -64,6 +61,30 @@ func expectedToken(l *Lexer, tType ...int) error {
 	return fmt.Errorf("[%d] unexpected token type %s found", token.LineNo, TokenTypeNames[token.Type])
 }
 
+// parseDirective reads a directive and its optional, comma separated
+// arguments, e.g. ".requires console, fs"
+func parseDirective(l *Lexer, currToken *Token) (Node, error) {
+	node := &DirectiveNode{
+		Directive: currToken.Literal[1:],
+		LineNo:    currToken.LineNo,
+	}
+
+	for {
+		token := l.NextToken()
+		switch {
+		case token.Type == TokenTypeEOL || token.Type == TokenTypeComment || token.Type == TokenTypeEOF:
+			l.PushToken(token)
+			return node, expectedToken(l, TokenTypeEOL, TokenTypeComment, TokenTypeEOF)
+		case token.Type == TokenTypeIdentifier && token.Literal == ",":
+			continue
+		case token.Type == TokenTypeIdentifier || token.Type == TokenTypeNumber:
+			node.Args = append(node.Args, token.Literal)
+		default:
+			return nil, fmt.Errorf("[%d] unexpected directive argument '%s'", token.LineNo, token.Literal)
+		}
+	}
+}
+
 func parseInstruction(l *Lexer, currToken *Token) (Node, error) {
 	instr, err := opcodes.GetInstructionByPneumonic(currToken.Literal)
 	if err != nil {
@@ -73,8 +94,14 @@ func parseInstruction(l *Lexer, currToken *Token) (Node, error) {
 	var operand string
 
 	nextToken := l.NextToken()
-	if instr.Param == opcodes.INT32 && (nextToken.Type == TokenTypeIdentifier || nextToken.Type == TokenTypeNumber) {
+	if nextToken.Type == TokenTypeIllegal {
+		return nil, fmt.Errorf("[%d] invalid string %s", nextToken.LineNo, nextToken.Literal)
+	} else if instr.Param == opcodes.INT32 && (nextToken.Type == TokenTypeIdentifier || nextToken.Type == TokenTypeNumber) {
+		operand = nextToken.Literal
+	} else if instr.Param == opcodes.STRING && nextToken.Type == TokenTypeString {
 		operand = nextToken.Literal
+	} else if instr.Param == opcodes.STRING {
+		return nil, fmt.Errorf("[%d] expected string, found '%s'", nextToken.LineNo, nextToken.Literal)
 	} else if instr.Param == opcodes.NONE && nextToken.Type == TokenTypeEOL {
 		l.PushToken(nextToken)
 		operand = ""
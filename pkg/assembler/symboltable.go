@@ -5,29 +5,36 @@ import (
 	"fmt"
 )
 
-var symbolTable map[string]int32
+// SymbolTable holds the labels defined while assembling one program
+type SymbolTable struct {
+	symbols map[string]int32
+}
+
+func NewSymbolTable() *SymbolTable {
+	result := &SymbolTable{
+		symbols: make(map[string]int32),
+	}
+	result.symbols["index"] = 0
 
-func init() {
-	symbolTable = make(map[string]int32)
-	symbolTable["index"] = 0
+	return result
 }
 
-func AddSymbol(name string, value int32) error {
-	_, ok := symbolTable[name]
+func (s *SymbolTable) AddSymbol(name string, value int32) error {
+	_, ok := s.symbols[name]
 	if ok {
 		return errors.New(fmt.Sprintf("symbol '%s' already defined", name))
 	}
 
-	symbolTable[name] = value
+	s.symbols[name] = value
 	return nil
 }
 
-func ReplaceSymbol(name string, value int32) {
-	symbolTable[name] = value
+func (s *SymbolTable) ReplaceSymbol(name string, value int32) {
+	s.symbols[name] = value
 }
 
-func GetSymbolValue(name string) (int32, error) {
-	v, ok := symbolTable[name]
+func (s *SymbolTable) GetSymbolValue(name string) (int32, error) {
+	v, ok := s.symbols[name]
 	if !ok {
 		return -1, errors.New(fmt.Sprintf("symbol '%s' undefined", name))
 	}
@@ -35,10 +42,10 @@ func GetSymbolValue(name string) (int32, error) {
 	return v, nil
 }
 
-func DisplaySymbolTable() string {
+func (s *SymbolTable) DisplaySymbolTable() string {
 	result := "Symbol Table:\n"
 
-	for k, v := range symbolTable {
+	for k, v := range s.symbols {
 		result += fmt.Sprintf("%15s : %08X [%d]\n", k, v, v)
 	}
 
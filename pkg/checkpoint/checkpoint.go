@@ -0,0 +1,124 @@
+package checkpoint
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+)
+
+// DefaultKeep is the number of checkpoints kept when none is given
+const DefaultKeep = 3
+
+// ErrNoCheckpoint is returned by Latest when the directory has no valid
+// checkpoint
+var ErrNoCheckpoint = errors.New("no valid checkpoint")
+
+// Dir is a directory of checkpoints for one program. Each is a snapshot
+// named after the instruction count it was taken at, so the newest sorts
+// last.
+type Dir struct {
+	Path string
+
+	// Keep is how many checkpoints to keep. Older ones are removed as new
+	// ones are written.
+	Keep int
+
+	// Program, if set, is the executable the checkpoints must come from.
+	// Latest passes over checkpoints of any other program.
+	Program string
+
+	// Skipped, if set, is told about each checkpoint Latest passes over
+	// because it can't be read or is of another program
+	Skipped func(filename string, err error)
+
+	// saved is the checkpoints written, or taken over with Continue, oldest
+	// first. Save only ever removes these, so checkpoints left by another
+	// run are never mistaken for this one's.
+	saved []string
+}
+
+// New makes the directory if it doesn't exist
+func New(path string, keep int) (*Dir, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	if keep < 1 {
+		keep = DefaultKeep
+	}
+
+	return &Dir{Path: path, Keep: keep}, nil
+}
+
+// Save writes a checkpoint and removes the oldest of those it has written
+// beyond Keep. It can be passed to Cpu.SetCheckpoint.
+func (d *Dir) Save(s *cpu.Snapshot) error {
+	filename := filepath.Join(d.Path, fmt.Sprintf("checkpoint-%012d.kbs", s.Instructions))
+	if err := s.Save(filename); err != nil {
+		return err
+	}
+
+	d.saved = slices.DeleteFunc(d.saved, func(f string) bool { return f == filename })
+	d.saved = append(d.saved, filename)
+	for len(d.saved) > d.Keep {
+		if err := os.Remove(d.saved[0]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		d.saved = d.saved[1:]
+	}
+
+	return nil
+}
+
+// Continue takes over the checkpoints already in the directory, so they
+// are pruned along with the ones Save writes. Use it when carrying on a
+// run resumed from this directory.
+func (d *Dir) Continue() error {
+	files, err := d.Files()
+	if err != nil {
+		return err
+	}
+
+	d.saved = append(files, d.saved...)
+	return nil
+}
+
+// Files lists the checkpoints, oldest first
+func (d *Dir) Files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(d.Path, "checkpoint-*.kbs"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// Latest returns the newest checkpoint that can be read, skipping any that
+// are damaged or only partly written, along with its filename
+func (d *Dir) Latest() (*cpu.Snapshot, string, error) {
+	files, err := d.Files()
+	if err != nil {
+		return nil, "", err
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		s, err := cpu.LoadSnapshot(files[i])
+		if err == nil && len(d.Program) > 0 && s.Program != d.Program {
+			err = fmt.Errorf("%s is of '%s', not '%s'", files[i], s.Program, d.Program)
+		}
+		if err == nil {
+			return s, files[i], nil
+		}
+		if d.Skipped != nil {
+			d.Skipped(files[i], err)
+		}
+	}
+
+	return nil, "", fmt.Errorf("%w in '%s'", ErrNoCheckpoint, d.Path)
+}
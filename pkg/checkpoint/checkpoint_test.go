@@ -0,0 +1,124 @@
+package checkpoint
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hculpan/kabbit/internal/vmtest"
+	"github.com/hculpan/kabbit/pkg/cpu"
+)
+
+func TestCheckpoints(t *testing.T) {
+	ef := vmtest.Assemble(t, `
+        push 200
+loop:
+        minc total
+        dec
+        dup
+        jif loop
+        halt
+total:  wd 0
+`, nil)
+
+	d, err := New(filepath.Join(t.TempDir(), "checkpoints"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cpu.NewCpu(ef, nil)
+	c.SetCheckpoint(100, d.Save)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := d.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || filepath.Base(files[1]) != "checkpoint-000000000800.kbs" {
+		t.Fatalf("expected the last 2 checkpoints, got %v", files)
+	}
+
+	// a damaged newest checkpoint is passed over for the one before
+	if err := os.WriteFile(files[1], []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	skipped := 0
+	d.Skipped = func(string, error) { skipped++ }
+	s, filename, err := d.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != files[0] || skipped != 1 || s.Instructions != 700 {
+		t.Fatalf("expected %s, got %s at %d instructions", files[0], filename, s.Instructions)
+	}
+
+	c = cpu.NewCpu(ef, nil)
+	if err := c.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Heap[1] != 200 {
+		t.Fatalf("expected a total of 200, got %d", c.Heap[1])
+	}
+
+	os.Remove(files[0])
+	if _, _, err := d.Latest(); !errors.Is(err, ErrNoCheckpoint) {
+		t.Fatalf("expected no checkpoint, got %v", err)
+	}
+}
+
+func TestCheckpointsFromAnotherRun(t *testing.T) {
+	c := cpu.NewCpu(vmtest.Assemble(t, `
+        push 1
+        halt
+`, nil), nil)
+
+	path := filepath.Join(t.TempDir(), "checkpoints")
+	other, err := New(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Program = "other.kbx"
+	s.Instructions = 5000
+	if err := other.Save(s); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Program = "mine.kbx"
+	s.Program = "mine.kbx"
+	s.Instructions = 100
+	if err := d.Save(s); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := d.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected both runs' checkpoints to be kept, got %v", files)
+	}
+
+	skipped := 0
+	d.Skipped = func(string, error) { skipped++ }
+	latest, _, err := d.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Program != "mine.kbx" || latest.Instructions != 100 || skipped != 1 {
+		t.Fatalf("expected this program's checkpoint, got %s at %d", latest.Program, latest.Instructions)
+	}
+}
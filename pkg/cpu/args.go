@@ -0,0 +1,49 @@
+package cpu
+
+import (
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// SetArgs gives the program its arguments, read with ARGC and ARGV. By
+// convention the first one is the name of the program.
+func (c *Cpu) SetArgs(args []string) {
+	c.args = args
+}
+
+// SetEnv exposes environment variables, each in "NAME=value" form, to the
+// program through ENVC and ENVV
+func (c *Cpu) SetEnv(env []string) {
+	c.env = env
+}
+
+func (c *Cpu) argsOp(opcode int32, param int32) error {
+	list := c.args
+	if opcode == opcodes.ENVC || opcode == opcodes.ENVV {
+		list = c.env
+	}
+
+	if opcode == opcodes.ARGC || opcode == opcodes.ENVC {
+		return c.push(int32(len(list)))
+	}
+
+	size, err := c.pop()
+	if err != nil {
+		return err
+	}
+	index, err := c.pop()
+	if err != nil {
+		return err
+	}
+
+	if index < 0 || int(index) >= len(list) {
+		return c.push(ErrCodeNotFound)
+	} else if size < 1 {
+		return c.push(ErrCodeInvalid)
+	}
+
+	if err := c.writeString(param, size, list[index]); err != nil {
+		return err
+	}
+
+	return c.push(int32(len(list[index])))
+}
@@ -0,0 +1,136 @@
+package cpu
+
+import (
+	"sync/atomic"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// AtomicObserver can be implemented by an Observer that needs to tell
+// atomic instructions apart from ordinary memory access. Observers that
+// implement it get Atomic in place of MemoryRead and MemoryWrite for CAS
+// and FETCHADD, and Fence for FENCE.
+type AtomicObserver interface {
+	Atomic(c *Cpu, addr int32, old int32, new int32)
+	Fence(c *Cpu)
+}
+
+// NewCore creates a cpu to run file as one core of a multi-core machine,
+// sharing heap rather than allocating a heap of its own. It is NewCpu
+// followed by ShareHeap, without the heap NewCpu would throw away.
+func NewCore(file *executable.ExecutableFile, core int32, heap []int32) *Cpu {
+	result := newCpu(file, nil, int(file.Header.StackSize), heap)
+	result.ShareHeap(core, heap)
+	return result
+}
+
+// ShareHeap makes the cpu one core of a multi-core machine, using heap in
+// place of its own. Every access to a shared heap is made with sync/atomic,
+// so cores can run on separate goroutines.
+func (c *Cpu) ShareHeap(core int32, heap []int32) {
+	c.core = core
+	c.Heap = heap
+	c.heapSize = len(heap)
+	c.sharedHeap = true
+}
+
+// CoreID returns the core number given to ShareHeap, or 0
+func (c *Cpu) CoreID() int32 {
+	return c.core
+}
+
+// peek reads a heap word without telling observers
+func (c *Cpu) peek(addr int32) int32 {
+	if c.sharedHeap {
+		return atomic.LoadInt32(&c.Heap[addr])
+	}
+	return c.Heap[addr]
+}
+
+func (c *Cpu) atomicOp(opcode int32, param int32) error {
+	switch opcode {
+	case opcodes.COREID:
+		return c.push(c.core)
+	case opcodes.FENCE:
+		for _, o := range c.observers {
+			if a, ok := o.(AtomicObserver); ok {
+				a.Fence(c)
+			}
+		}
+		return nil
+	}
+
+	if err := c.checkAddress(param); err != nil {
+		return err
+	}
+
+	var old, new int32
+	var result int32
+	switch opcode {
+	case opcodes.CAS:
+		// pops the new value, then the value expected, and pushes 1 if
+		// the swap was made
+		v, err := c.pop()
+		if err != nil {
+			return err
+		}
+		expected, err := c.pop()
+		if err != nil {
+			return err
+		}
+
+		if c.sharedHeap {
+			if atomic.CompareAndSwapInt32(&c.Heap[param], expected, v) {
+				old, new, result = expected, v, 1
+			} else {
+				old = atomic.LoadInt32(&c.Heap[param])
+				new = old
+			}
+		} else {
+			old, new = c.Heap[param], c.Heap[param]
+			if old == expected && c.history != nil {
+				c.recordWrite(c.Heap, param, true)
+			}
+			if old == expected {
+				c.Heap[param], new, result = v, v, 1
+			}
+		}
+	case opcodes.FETCHADD:
+		// pops the amount to add and pushes the old value
+		delta, err := c.pop()
+		if err != nil {
+			return err
+		}
+
+		if c.sharedHeap {
+			new = atomic.AddInt32(&c.Heap[param], delta)
+			old = new - delta
+		} else {
+			if c.history != nil {
+				c.recordWrite(c.Heap, param, true)
+			}
+			old = c.Heap[param]
+			new = old + delta
+			c.Heap[param] = new
+		}
+		result = old
+	}
+
+	c.notifyAtomic(param, old, new)
+	return c.push(result)
+}
+
+func (c *Cpu) notifyAtomic(addr int32, old int32, new int32) {
+	for _, o := range c.observers {
+		if a, ok := o.(AtomicObserver); ok {
+			a.Atomic(c, addr, old, new)
+			continue
+		}
+
+		o.MemoryRead(c, addr, old)
+		if old != new {
+			o.MemoryWrite(c, addr, old, new)
+		}
+	}
+}
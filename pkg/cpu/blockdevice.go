@@ -0,0 +1,81 @@
+package cpu
+
+import (
+	"fmt"
+
+	"github.com/hculpan/kabbit/pkg/disk"
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// BlockDevice is the storage behind the READBLK, WRITEBLK and BLKCNT
+// instructions. Blocks are disk.BlockSize words long.
+type BlockDevice interface {
+	Blocks() int
+	ReadBlock(n int, buf []int32) error
+	WriteBlock(n int, buf []int32) error
+}
+
+// AttachDisk connects a block device to the cpu. Passing nil detaches
+// the current device.
+func (c *Cpu) AttachDisk(d BlockDevice) {
+	c.disk = d
+}
+
+func (c *Cpu) blockOp(opcode int32, param int32) error {
+	if err := c.require(executable.CapDisk); err != nil {
+		return err
+	}
+
+	if c.disk == nil {
+		return fmt.Errorf("%w: no disk", ErrNoDevice)
+	}
+
+	if opcode == opcodes.BLKCNT {
+		return c.push(int32(c.disk.Blocks()))
+	}
+
+	if param < 0 || int(param)+disk.BlockSize > c.heapSize {
+		return fmt.Errorf("%w: block buffer at %d", ErrInvalidMemory, param)
+	}
+
+	block, err := c.pop()
+	if err != nil {
+		return err
+	}
+
+	if block < 0 || int(block) >= c.disk.Blocks() {
+		return fmt.Errorf("%w: block %d, disk has %d blocks", ErrInvalidOperand, block, c.disk.Blocks())
+	}
+
+	buf := c.Heap[param : int(param)+disk.BlockSize]
+	if len(c.observers) == 0 && !c.sharedHeap && c.history == nil {
+		if opcode == opcodes.READBLK {
+			return c.disk.ReadBlock(int(block), buf)
+		}
+		return c.disk.WriteBlock(int(block), buf)
+	}
+
+	// with observers watching, other cores sharing the heap or a history
+	// being kept, go word by word so each read and write is reported,
+	// atomic and can be undone
+	words := make([]int32, disk.BlockSize)
+	if opcode == opcodes.READBLK {
+		if err := c.disk.ReadBlock(int(block), words); err != nil {
+			return err
+		}
+		for i, v := range words {
+			c.store(param+int32(i), v)
+		}
+	} else {
+		for i := range words {
+			words[i] = c.load(param + int32(i))
+		}
+		if err := c.disk.WriteBlock(int(block), words); err != nil {
+			return err
+		}
+	}
+
+	c.notifyIO(IOEvent{Opcode: opcode, Block: block})
+	return nil
+}
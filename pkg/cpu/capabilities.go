@@ -0,0 +1,25 @@
+package cpu
+
+import (
+	"fmt"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// SetCapabilities replaces the set of facilities the program may use. A
+// new cpu is granted the capabilities recorded in its executable.
+func (c *Cpu) SetCapabilities(caps executable.Capabilities) {
+	c.capabilities = caps
+}
+
+func (c *Cpu) Capabilities() executable.Capabilities {
+	return c.capabilities
+}
+
+func (c *Cpu) require(caps executable.Capabilities) error {
+	if !c.capabilities.Has(caps) {
+		return fmt.Errorf("%w: %s", ErrCapability, caps&^c.capabilities)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package cpu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// DefaultPrompt is shown before each IN on an interactive console
+const DefaultPrompt = "-> "
+
+// console is where IN reads from and OUT writes to.
+//
+// An interactive console prompts before each IN and asks again when a line
+// isn't a number. A non-interactive one never prompts, skips blank lines,
+// and stops the program with an error naming the line when one isn't a
+// number. Either way, IN at the end of input pushes 0 and sets the flag
+// read by EOF.
+type console struct {
+	in          *bufio.Reader
+	out         io.Writer
+	prompt      string
+	interactive bool
+	line        int
+	eof         bool
+}
+
+func newConsole() *console {
+	return &console{
+		in:          bufio.NewReader(os.Stdin),
+		out:         os.Stdout,
+		prompt:      DefaultPrompt,
+		interactive: true,
+	}
+}
+
+// SetInput makes IN read lines from r
+func (c *Cpu) SetInput(r io.Reader, interactive bool) {
+	c.console.in = bufio.NewReader(r)
+	c.console.interactive = interactive
+	c.console.line = 0
+	c.console.eof = false
+}
+
+// SetOutput sends the output of OUT, and any prompts, to w
+func (c *Cpu) SetOutput(w io.Writer) {
+	c.console.out = w
+}
+
+// SetPrompt changes the prompt shown on an interactive console; an empty
+// prompt shows nothing
+func (c *Cpu) SetPrompt(prompt string) {
+	c.console.prompt = prompt
+}
+
+// InputLine returns the number of lines consumed from the input so far
+func (c *Cpu) InputLine() int {
+	return c.console.line
+}
+
+// readInteger returns the next number from the input, and whether the
+// input had already ended
+func (con *console) readInteger() (int32, bool, error) {
+	for {
+		if con.interactive && len(con.prompt) > 0 {
+			fmt.Fprint(con.out, con.prompt)
+		}
+
+		input, err := con.in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		} else if err == io.EOF && len(input) == 0 {
+			return 0, true, nil
+		}
+		con.line++
+
+		input = strings.TrimSpace(input)
+		n, parseErr := strconv.ParseInt(input, 10, 32)
+		if parseErr == nil {
+			return int32(n), false, nil
+		} else if con.interactive || len(input) == 0 {
+			if err == io.EOF {
+				return 0, true, nil
+			}
+			continue
+		}
+
+		return 0, false, fmt.Errorf("%w on line %d: '%s'", ErrMalformedInput, con.line, input)
+	}
+}
+
+// outs prints the string at addr, without adding a newline
+func (c *Cpu) outs(addr int32) error {
+	s, err := c.readString(addr)
+	if err != nil {
+		return err
+	}
+
+	c.consoleOut(opcodes.OUTS, s)
+	return nil
+}
+
+// printf prints the format string at addr, taking one value from the stack
+// for each verb. Values are used in the order they were pushed. The verbs
+// are %d (decimal), %x (hex), %c (character), %s (the string at an
+// address) and %% for a percent sign.
+func (c *Cpu) printf(addr int32) error {
+	format, err := c.readString(addr)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		i++
+		if i >= len(format) {
+			return fmt.Errorf("%w: format string ends with '%%'", ErrInvalidOperand)
+		}
+
+		switch format[i] {
+		case 'd', 'x', 'c', 's':
+			count++
+		case '%':
+		default:
+			return fmt.Errorf("%w: unknown format verb '%%%c'", ErrInvalidOperand, format[i])
+		}
+	}
+
+	args := make([]int32, count)
+	for i := count - 1; i >= 0; i-- {
+		if args[i], err = c.pop(); err != nil {
+			return err
+		}
+	}
+
+	var result strings.Builder
+	arg := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			result.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		switch format[i] {
+		case 'd':
+			result.WriteString(strconv.Itoa(int(args[arg])))
+		case 'x':
+			result.WriteString(fmt.Sprintf("%X", args[arg]))
+		case 'c':
+			result.WriteByte(byte(args[arg]))
+		case 's':
+			s, err := c.readString(args[arg])
+			if err != nil {
+				return err
+			}
+			result.WriteString(s)
+		case '%':
+			result.WriteByte('%')
+			continue
+		}
+		arg++
+	}
+
+	c.consoleOut(opcodes.PRINTF, result.String())
+	return nil
+}
+
+func (c *Cpu) consoleOut(opcode int32, s string) {
+	fmt.Fprint(c.console.out, s)
+	if len(c.observers) > 0 {
+		c.notifyIO(IOEvent{Opcode: opcode, Descriptor: 1, Data: []byte(s)})
+	}
+}
@@ -0,0 +1,237 @@
+package cpu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// State is where a cpu is in its life cycle
+type State int
+
+const (
+	StateReady State = iota
+	StateRunning
+	StatePaused
+	StateHalted
+	StateStopped
+	StateFaulted
+)
+
+var stateNames []string = []string{
+	"ready",
+	"running",
+	"paused",
+	"halted",
+	"stopped",
+	"faulted",
+}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+
+	return stateNames[s]
+}
+
+// ErrInterrupted is returned by Run when the cpu is stopped from outside
+var ErrInterrupted = errors.New("interrupted")
+
+var ErrNotRunning = errors.New("cpu not running")
+var ErrNotPaused = errors.New("cpu not paused")
+
+// errRestart tells Step to undo an instruction that was waiting when a
+// pause was requested, so that it runs again after Resume
+var errRestart = errors.New("restart instruction")
+
+// control coordinates a running cpu with the goroutines controlling it.
+// pending lets the run loop check for requests without taking the lock.
+type control struct {
+	mu             sync.Mutex
+	cond           *sync.Cond
+	state          State
+	pauseRequested bool
+	stopCause      error
+	pending        atomic.Bool
+}
+
+func newControl() *control {
+	result := &control{}
+	result.cond = sync.NewCond(&result.mu)
+	return result
+}
+
+// State returns the current state. It's safe to call from any goroutine.
+func (c *Cpu) State() State {
+	c.ctl.mu.Lock()
+	defer c.ctl.mu.Unlock()
+
+	return c.ctl.state
+}
+
+// Pause stops a running cpu at the next instruction boundary and waits
+// until it has. The cpu can then be inspected, and modified, until Resume
+// is called; it continues from the same instruction. An instruction
+// waiting on a socket is abandoned and run again on resume.
+func (c *Cpu) Pause() error {
+	c.ctl.mu.Lock()
+	defer c.ctl.mu.Unlock()
+
+	switch c.ctl.state {
+	case StatePaused:
+		return nil
+	case StateRunning:
+		c.ctl.pauseRequested = true
+		c.ctl.pending.Store(true)
+		for c.ctl.state == StateRunning {
+			c.ctl.cond.Wait()
+		}
+		if c.ctl.state != StatePaused {
+			return ErrNotRunning
+		}
+		return nil
+	default:
+		return ErrNotRunning
+	}
+}
+
+// Resume continues a paused cpu
+func (c *Cpu) Resume() error {
+	c.ctl.mu.Lock()
+	defer c.ctl.mu.Unlock()
+
+	if c.ctl.state != StatePaused {
+		return ErrNotPaused
+	}
+
+	c.ctl.pauseRequested = false
+	c.ctl.pending.Store(c.ctl.stopCause != nil)
+	c.ctl.cond.Broadcast()
+	return nil
+}
+
+// Stop ends a running or paused cpu, making Run return ErrInterrupted.
+// Stopping a cpu that hasn't started yet makes its next Run return
+// straight away. It's safe to call from any goroutine.
+func (c *Cpu) Stop() {
+	c.stop(ErrInterrupted)
+}
+
+// Interrupt is the same as Stop
+func (c *Cpu) Interrupt() {
+	c.Stop()
+}
+
+// RunContext is Run, stopping the cpu if ctx is cancelled. The error then
+// matches both ErrInterrupted and the context's error.
+func (c *Cpu) RunContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInterrupted, err)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		c.stop(fmt.Errorf("%w: %w", ErrInterrupted, context.Cause(ctx)))
+	})
+	defer stop()
+
+	return c.Run()
+}
+
+func (c *Cpu) stop(cause error) {
+	c.ctl.mu.Lock()
+	defer c.ctl.mu.Unlock()
+
+	switch c.ctl.state {
+	case StateReady, StateRunning, StatePaused:
+		if c.ctl.stopCause == nil {
+			c.ctl.stopCause = cause
+		}
+		c.ctl.pending.Store(true)
+		c.ctl.cond.Broadcast()
+	}
+}
+
+// startRun moves the cpu into the running state, unless it was stopped
+// before it could start
+func (c *Cpu) startRun() error {
+	c.ctl.mu.Lock()
+	defer c.ctl.mu.Unlock()
+
+	if c.ctl.stopCause != nil {
+		return c.endRun(StateStopped)
+	}
+
+	c.ctl.state = StateRunning
+	c.ctl.cond.Broadcast()
+	return nil
+}
+
+// finishRun records how a run ended
+func (c *Cpu) finishRun(state State) {
+	c.ctl.mu.Lock()
+	defer c.ctl.mu.Unlock()
+
+	c.endRun(state)
+}
+
+// endRun must be called with the lock held. It returns the stop cause,
+// if there was one.
+func (c *Cpu) endRun(state State) error {
+	cause := c.ctl.stopCause
+
+	c.ctl.state = state
+	c.ctl.pauseRequested = false
+	c.ctl.stopCause = nil
+	c.ctl.pending.Store(false)
+	c.ctl.cond.Broadcast()
+
+	return cause
+}
+
+// handleControl is called by the run loop between instructions when a
+// request is pending. It blocks while the cpu is paused, and returns the
+// cause if the cpu has been stopped.
+func (c *Cpu) handleControl() error {
+	c.ctl.mu.Lock()
+	defer c.ctl.mu.Unlock()
+
+	for c.ctl.pauseRequested && c.ctl.stopCause == nil {
+		if c.ctl.state != StatePaused {
+			c.ctl.state = StatePaused
+			c.ctl.cond.Broadcast()
+		}
+		c.ctl.cond.Wait()
+	}
+
+	if c.ctl.stopCause != nil {
+		return c.ctl.stopCause
+	}
+
+	c.ctl.state = StateRunning
+	c.ctl.cond.Broadcast()
+	return nil
+}
+
+// waitCheck is used by instructions that wait on something outside the
+// cpu. It returns ErrInterrupted if the cpu is being stopped, and
+// errRestart if a pause has been requested and the instruction can safely
+// be run again from the start.
+func (c *Cpu) waitCheck(canRestart bool) error {
+	if !c.ctl.pending.Load() {
+		return nil
+	}
+
+	c.ctl.mu.Lock()
+	defer c.ctl.mu.Unlock()
+
+	if c.ctl.stopCause != nil {
+		return c.ctl.stopCause
+	} else if c.ctl.pauseRequested && canRestart {
+		return errRestart
+	}
+
+	return nil
+}
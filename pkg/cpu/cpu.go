@@ -1,17 +1,18 @@
 package cpu
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"os"
-	"strconv"
-	"strings"
+	"io"
 
 	"github.com/hculpan/kabbit/pkg/executable"
 	"github.com/hculpan/kabbit/pkg/opcodes"
+	"github.com/hculpan/kabbit/pkg/vfs"
 )
 
+// MonitorFunc is called before the first instruction and after each one.
+//
+// Deprecated: use an Observer, which is told exactly what changed.
 type MonitorFunc func(cpu *Cpu, lastError *error)
 
 type Cpu struct {
@@ -21,56 +22,265 @@ type Cpu struct {
 	Code               []int32
 	Heap               []int32
 
+	// Deprecated: use AddObserver
 	Monitor MonitorFunc
 
-	halted    bool
-	stackSize int
-	heapSize  int
-	codeSize  int
+	file        *executable.ExecutableFile
+	disk        BlockDevice
+	fileSystem  vfs.FileSystem
+	descriptors map[int32]io.Closer
+	network     *networkPolicy
+	mailboxes   Mailboxes
+	address     int32
+	syscalls    *Syscalls
+
+	console      *console
+	capabilities executable.Capabilities
+	args         []string
+	env          []string
+	ctl          *control
+	observers    []Observer
+
+	halted       bool
+	started      bool
+	stopTimer    func()
+	core         int32
+	sharedHeap   bool
+	instructions int64
+	limits       Limits
+	gasUsed      int64
+	stackLimit   int
+	threads      []*thread
+	current      int32
+	quantum      int
+	slice        int
+	reschedule   bool
+	stackSize    int
+	heapSize     int
+	codeSize     int
+
+	nondeterminism  NondeterminismFunc
+	history         *history
+	checkpointEvery int64
+	checkpointFunc  func(*Snapshot) error
+	lastCheckpoint  int64
 }
 
+// NewCpu prepares a cpu to run file. The heap starts as a copy of the
+// file's data, so the same file can be used for any number of cpus.
 func NewCpu(file *executable.ExecutableFile, monitorFunc MonitorFunc) *Cpu {
+	result := NewCpuWithStack(file, nil)
+	result.Monitor = monitorFunc
+	return result
+}
+
+// NewCpuWithStack is NewCpu using stack, if it's big enough, rather than
+// allocating a new one. A stack can be reused once the cpu that had it is
+// finished with; the program can't see anything left above its stack
+// pointer.
+func NewCpuWithStack(file *executable.ExecutableFile, stack []int32) *Cpu {
+	return newCpu(file, stack, int(file.Header.StackSize), nil)
+}
+
+// NewLimitedCpu is NewCpuWithStack for programs that can't be trusted.
+// The file is checked against limits before anything is allocated, and
+// the cpu starts out with those limits. The stack is only as big as
+// MaxStackDepth lets the program use, whatever size the file asks for.
+func NewLimitedCpu(file *executable.ExecutableFile, stack []int32, limits Limits) (*Cpu, error) {
+	if err := limits.CheckFile(file); err != nil {
+		return nil, err
+	}
+
+	words := int(file.Header.StackSize)
+	if limits.MaxStackDepth > 0 && limits.MaxStackDepth < words {
+		words = limits.MaxStackDepth
+	}
+
+	result := newCpu(file, stack, words, nil)
+	result.SetLimits(limits)
+	return result, nil
+}
+
+// newCpu builds a cpu for file with a stack of stackWords, reusing stack
+// if it's big enough. A nil heap gets a new one filled from the file.
+func newCpu(file *executable.ExecutableFile, stack []int32, stackWords int, heap []int32) *Cpu {
+	if heap == nil {
+		heap = make([]int32, file.Header.HeapSize)
+		copy(heap, file.Data)
+	}
+
+	if len(stack) < stackWords {
+		stack = make([]int32, stackWords)
+	}
+
 	return &Cpu{
 		StackPointer:       0,
 		InstructionPointer: 0,
-		Stack:              make([]int32, file.Header.StackSize),
+		Stack:              stack[:stackWords],
 		Code:               file.Code,
-		Heap:               file.Data,
+		Heap:               heap,
+		file:               file,
 		halted:             false,
 		stackSize:          int(file.Header.StackSize),
+		stackLimit:         stackWords,
 		codeSize:           len(file.Code),
-		heapSize:           int(file.Header.HeapSize),
-		Monitor:            monitorFunc,
+		heapSize:           len(heap),
+		syscalls:           StandardSyscalls(),
+		console:            newConsole(),
+		ctl:                newControl(),
+		quantum:            DefaultQuantum,
+		capabilities:       file.Capabilities,
 	}
 }
 
+// Run executes instructions until HALT, an error, or Stop. Use Pause,
+// Resume and Stop from another goroutine to control it.
 func (c *Cpu) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	return c.RunSteps(-1)
+}
+
+// Start begins a run that is then driven with RunSteps, for schedulers
+// that interleave several cpus on one goroutine. Limits, observers and
+// Monitor apply just as they do to Run. If Start fails the run is already
+// over.
+func (c *Cpu) Start() error {
+	if err := c.startRun(); err != nil {
+		return err
+	}
+	c.started = true
 	c.halted = false
 
+	if err := c.checkHeapLimit(); err != nil {
+		c.finish(StateFaulted, err)
+		return err
+	}
+	c.stopTimer = c.startTimeLimit()
+
 	if c.Monitor != nil {
 		c.Monitor(c, nil)
 	}
 
-	for !c.halted {
+	return nil
+}
+
+// RunSteps continues a run begun with Start for up to n instructions, or
+// until it ends if n is negative. The run is over once the cpu has halted
+// or an error is returned.
+func (c *Cpu) RunSteps(n int) error {
+	if !c.started {
+		return ErrNotRunning
+	}
+
+	for i := 0; (n < 0 || i < n) && !c.halted; i++ {
+		if c.ctl.pending.Load() {
+			if err := c.handleControl(); err != nil {
+				c.finish(StateStopped, err)
+				return err
+			}
+		}
+
 		err := c.Step()
 		if c.Monitor != nil {
 			c.Monitor(c, &err)
 		}
+		if err == nil && c.checkpointEvery > 0 {
+			err = c.checkpoint()
+		}
 		if err != nil {
 			c.halted = true
+			c.finish(StateFaulted, err)
 			return err
 		}
 	}
 
-	c.halted = true
+	if c.halted {
+		c.finish(StateHalted, nil)
+	}
 	return nil
 }
 
+// finish ends a run. Observers are told before descriptors are closed, so
+// they can see what the program left open.
+func (c *Cpu) finish(state State, err error) {
+	c.started = false
+	c.finishRun(state)
+	if c.stopTimer != nil {
+		c.stopTimer()
+		c.stopTimer = nil
+	}
+
+	for _, o := range c.observers {
+		o.Halt(c, err)
+	}
+	c.closeDescriptors()
+}
+
 func (c *Cpu) IsHalted() bool {
 	return c.halted
 }
 
+// Instructions returns the number of instructions executed so far
+func (c *Cpu) Instructions() int64 {
+	return c.instructions
+}
+
+// Step executes a single instruction
 func (c *Cpu) Step() error {
+	ip, sp := c.InstructionPointer, c.StackPointer
+	if ip < 0 || ip+1 >= len(c.Code) {
+		c.halted = true
+		return c.newFault(ErrInvalidIP, ip, sp)
+	}
+
+	if c.history != nil {
+		c.record()
+	}
+	if err := c.charge(c.Code[ip]); err != nil {
+		if c.history != nil {
+			c.history.discard()
+		}
+		return c.newFault(err, ip, sp)
+	}
+	c.instructions++
+
+	if len(c.observers) > 0 {
+		for _, o := range c.observers {
+			o.BeforeInstruction(c, ip, c.Code[ip], c.Code[ip+1])
+		}
+	}
+
+	err := c.step()
+	if err == nil && c.threads != nil {
+		c.slice++
+		if c.reschedule || (c.quantum > 0 && c.slice >= c.quantum) {
+			err = c.schedule()
+		}
+	}
+
+	switch {
+	case err == nil:
+		return nil
+	case err == errRestart:
+		// the instruction was waiting when a pause was requested, so put
+		// back anything it popped and let it run again on resume
+		c.StackPointer = sp
+		c.instructions--
+		if c.history != nil {
+			c.history.discard()
+		}
+		return nil
+	case errors.Is(err, ErrInterrupted):
+		return err
+	}
+
+	return c.newFault(err, ip, sp)
+}
+
+func (c *Cpu) step() error {
 	opcode := c.Code[c.InstructionPointer]
 	param := c.Code[c.InstructionPointer+1]
 	switch opcode {
@@ -98,23 +308,67 @@ func (c *Cpu) Step() error {
 			return err
 		}
 	case opcodes.OUT:
+		if err := c.require(executable.CapConsole); err != nil {
+			return err
+		}
+
 		v, err := c.pop()
 		if err != nil {
 			return err
 		}
 
-		fmt.Println(v)
+		text := fmt.Sprintln(v)
+		fmt.Fprint(c.console.out, text)
+		if len(c.observers) > 0 {
+			c.notifyIO(IOEvent{Opcode: opcode, Descriptor: 1, Data: []byte(text)})
+		}
 	case opcodes.IN:
-		var num int32 = 0
-		if v, err := readInteger("-> "); err == nil {
-			num = int32(v)
+		if err := c.require(executable.CapConsole); err != nil {
+			return err
+		}
+
+		num, eof, err := c.nondeterministic(ValueInput, c.console.readInteger)
+		if err != nil {
+			return err
+		}
+		c.console.eof = eof
+		if len(c.observers) > 0 && !eof {
+			c.notifyIO(IOEvent{Opcode: opcode, Descriptor: 0, Data: []byte(fmt.Sprint(num))})
 		}
 		if err := c.push(num); err != nil {
 			return err
 		}
+	case opcodes.OUTS, opcodes.PRINTF:
+		if err := c.require(executable.CapConsole); err != nil {
+			return err
+		}
+
+		if opcode == opcodes.OUTS {
+			if err := c.outs(param); err != nil {
+				return err
+			}
+		} else if err := c.printf(param); err != nil {
+			return err
+		}
+	case opcodes.EOF:
+		if err := c.require(executable.CapConsole); err != nil {
+			return err
+		}
+
+		var v int32 = 0
+		if c.console.eof {
+			v = 1
+		}
+		if err := c.push(v); err != nil {
+			return err
+		}
+	case opcodes.ARGC, opcodes.ARGV, opcodes.ENVC, opcodes.ENVV:
+		if err := c.argsOp(opcode, param); err != nil {
+			return err
+		}
 	case opcodes.ST:
-		if param >= int32(c.heapSize) {
-			return errors.New(fmt.Sprintf("invalid memory location %d", param))
+		if err := c.checkAddress(param); err != nil {
+			return err
 		}
 
 		v, err := c.pop()
@@ -122,19 +376,20 @@ func (c *Cpu) Step() error {
 			return err
 		}
 
-		c.Heap[param] = v
+		c.store(param, v)
 	case opcodes.LD:
-		if param >= int32(c.heapSize) {
-			return errors.New(fmt.Sprintf("invalid memory location %d", param))
+		if err := c.checkAddress(param); err != nil {
+			return err
 		}
 
-		v := c.Heap[param]
+		v := c.load(param)
 		if err := c.push(v); err != nil {
 			return err
 		}
 	case opcodes.STI:
-		if param+c.Heap[0] >= int32(c.heapSize) {
-			return errors.New(fmt.Sprintf("invalid memory location %d", param))
+		addr := param + c.load(0)
+		if err := c.checkAddress(addr); err != nil {
+			return err
 		}
 
 		v, err := c.pop()
@@ -142,13 +397,14 @@ func (c *Cpu) Step() error {
 			return err
 		}
 
-		c.Heap[param+c.Heap[0]] = v
+		c.store(addr, v)
 	case opcodes.LDI:
-		if param+c.Heap[0] >= int32(c.heapSize) {
-			return errors.New(fmt.Sprintf("invalid memory location %d", param))
+		addr := param + c.load(0)
+		if err := c.checkAddress(addr); err != nil {
+			return err
 		}
 
-		v := c.Heap[param+c.Heap[0]]
+		v := c.load(addr)
 		if err := c.push(v); err != nil {
 			return err
 		}
@@ -163,23 +419,27 @@ func (c *Cpu) Step() error {
 			return err
 		}
 
+		if opcode == opcodes.DIV && v2 == 0 {
+			return ErrDivideByZero
+		}
+
 		total := c.binaryOp(opcode, v1, v2)
 
 		if err := c.push(total); err != nil {
 			return err
 		}
 	case opcodes.MINC:
-		if param >= int32(c.heapSize) {
-			return errors.New(fmt.Sprintf("invalid memory location %d", param))
+		if err := c.checkAddress(param); err != nil {
+			return err
 		}
 
-		c.Heap[param] += 1
+		c.store(param, c.peek(param)+1)
 	case opcodes.MDEC:
-		if param >= int32(c.heapSize) {
-			return errors.New(fmt.Sprintf("invalid memory location %d", param))
+		if err := c.checkAddress(param); err != nil {
+			return err
 		}
 
-		c.Heap[param] -= 1
+		c.store(param, c.peek(param)-1)
 	case opcodes.DEC:
 		v, err := c.pop()
 		if err != nil {
@@ -199,16 +459,19 @@ func (c *Cpu) Step() error {
 			return err
 		}
 	case opcodes.DECI:
-		c.Heap[0]--
+		c.store(0, c.peek(0)-1)
 	case opcodes.INCI:
-		c.Heap[0]++
+		c.store(0, c.peek(0)+1)
 	case opcodes.JMP:
-		if param < int32(c.codeSize) {
+		if param >= 0 && param < int32(c.codeSize) {
+			if len(c.observers) > 0 {
+				c.notifyBranch(c.InstructionPointer, int(param))
+			}
 			c.InstructionPointer = int(param)
 			return nil
 		} else {
 			c.halted = true
-			return errors.New(fmt.Sprintf("invalid jmp address %d", param))
+			return fmt.Errorf("%w %d", ErrInvalidJump, param)
 		}
 	case opcodes.JIF:
 		v, err := c.pop()
@@ -217,19 +480,65 @@ func (c *Cpu) Step() error {
 		}
 
 		if v != 0 {
-			if param < int32(c.codeSize) {
+			if param >= 0 && param < int32(c.codeSize) {
+				if len(c.observers) > 0 {
+					c.notifyBranch(c.InstructionPointer, int(param))
+				}
 				c.InstructionPointer = int(param)
 				return nil
 			} else {
 				c.halted = true
-				return errors.New(fmt.Sprintf("invalid jmp address %d", param))
+				return fmt.Errorf("%w %d", ErrInvalidJump, param)
 			}
 		}
+	case opcodes.READBLK, opcodes.WRITEBLK, opcodes.BLKCNT:
+		if err := c.blockOp(opcode, param); err != nil {
+			return err
+		}
+	case opcodes.OPEN:
+		if err := c.openOp(param); err != nil {
+			return err
+		}
+	case opcodes.READ, opcodes.WRITE, opcodes.CLOSE, opcodes.SEND, opcodes.RECV:
+		if err := c.descriptorOp(opcode, param); err != nil {
+			return err
+		}
+	case opcodes.LISTEN, opcodes.ACCEPT, opcodes.CONNECT:
+		if err := c.socketOp(opcode, param); err != nil {
+			return err
+		}
+	case opcodes.SYS:
+		if err := c.syscall(param); err != nil {
+			return err
+		}
+	case opcodes.SPAWN, opcodes.YIELD, opcodes.JOIN, opcodes.THREADID:
+		if err := c.threadOp(opcode, param); err != nil {
+			return err
+		}
+	case opcodes.MSEND, opcodes.MRECV, opcodes.MSELF:
+		if err := c.messageOp(opcode, param); err != nil {
+			return err
+		}
+	case opcodes.CAS, opcodes.FETCHADD, opcodes.FENCE, opcodes.COREID:
+		if err := c.atomicOp(opcode, param); err != nil {
+			return err
+		}
 	case opcodes.HALT:
+		if c.current != 0 {
+			c.exitThread()
+			break
+		}
 		c.halted = true
 	default:
+		if opcodes.IsExtension(uint32(opcode)) {
+			if err := c.extension(opcode, param); err != nil {
+				return err
+			}
+			break
+		}
+
 		c.halted = true
-		return errors.New("invalid instruction")
+		return ErrInvalidInstruction
 	}
 
 	c.InstructionPointer += 2
@@ -304,43 +613,37 @@ func (c *Cpu) binaryOp(opcode int32, v1 int32, v2 int32) int32 {
 
 func (c *Cpu) pop() (int32, error) {
 	if c.StackPointer < 1 {
-		return 0, errors.New("stack underflow")
+		return 0, ErrStackUnderflow
 	}
 
 	c.StackPointer--
 	result := c.Stack[c.StackPointer]
+	if len(c.observers) > 0 {
+		for _, o := range c.observers {
+			o.Pop(c, result)
+		}
+	}
 
 	return result, nil
 }
 
 func (c *Cpu) push(v int32) error {
-	if c.StackPointer >= c.stackSize {
-		return errors.New("stack overflow")
+	if c.StackPointer >= c.stackLimit && c.stackLimit < c.stackSize {
+		return &LimitError{Kind: ErrStackLimit, Limit: int64(c.stackLimit)}
+	} else if c.StackPointer >= len(c.Stack) {
+		return ErrStackOverflow
 	}
 
+	if c.history != nil {
+		c.recordWrite(c.Stack, int32(c.StackPointer), false)
+	}
 	c.Stack[c.StackPointer] = v
 	c.StackPointer++
-
-	return nil
-}
-
-func readInteger(prompt string) (int32, error) {
-	reader := bufio.NewReader(os.Stdin)
-	var number int32
-	for {
-		fmt.Print(prompt)
-		input, err := reader.ReadString('\n')
-		if err != nil {
-			return 0, err
-		}
-
-		input = strings.TrimSpace(input)
-		n, err := strconv.Atoi(input)
-		if err == nil {
-			number = int32(n)
-			break
+	if len(c.observers) > 0 {
+		for _, o := range c.observers {
+			o.Push(c, v)
 		}
 	}
 
-	return number, nil
+	return nil
 }
@@ -0,0 +1,1186 @@
+package cpu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/assembler"
+	"github.com/hculpan/kabbit/pkg/disk"
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/opcodes"
+	"github.com/hculpan/kabbit/pkg/vfs"
+)
+
+func newTestCpu(t *testing.T, source string, syscalls *Syscalls) *Cpu {
+	t.Helper()
+
+	a := assembler.NewAssembler(false)
+	if syscalls != nil {
+		a.SetSyscalls(syscalls.Names())
+	}
+	code, err := a.Assemble(source)
+	if err != nil {
+		t.Fatalf("unable to assemble: %v", err)
+	}
+
+	c := NewCpu(code.NewExecutableFile("test.kbx"), nil)
+	if syscalls != nil {
+		c.SetSyscalls(syscalls)
+	}
+	return c
+}
+
+func TestSyscallByName(t *testing.T) {
+	syscalls := StandardSyscalls()
+	number, err := syscalls.RegisterNamed("double", func(c *Cpu) error {
+		v, err := c.Pop()
+		if err != nil {
+			return err
+		}
+		return c.Push(v * 2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number != 3 {
+		t.Fatalf("expected next free number 3, got %d", number)
+	}
+
+	c := newTestCpu(t, `
+        .requires sys
+result: wd 0
+        push 21
+        sys double
+        st result
+        halt
+`, syscalls)
+
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Heap[1] != 42 {
+		t.Fatalf("expected 42, got %d", c.Heap[1])
+	}
+}
+
+func TestUnknownSyscall(t *testing.T) {
+	c := newTestCpu(t, `
+        sys 99
+        halt
+`, nil)
+
+	if err := c.Run(); err == nil {
+		t.Fatal("expected error for unknown syscall")
+	}
+}
+
+func TestExtensionInstruction(t *testing.T) {
+	err := RegisterExtension("addn", opcodes.ExtensionFirst, opcodes.INT32, func(c *Cpu, operand int32) error {
+		v, err := c.Pop()
+		if err != nil {
+			return err
+		}
+		return c.Push(v + operand)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { UnregisterExtension(opcodes.ExtensionFirst) })
+
+	if err := RegisterExtension("push", opcodes.ExtensionFirst+1, opcodes.NONE, func(c *Cpu, operand int32) error { return nil }); err == nil {
+		t.Fatal("expected error reusing a built in pneumonic")
+	}
+	if err := RegisterExtension("other", opcodes.ExtensionFirst, opcodes.NONE, func(c *Cpu, operand int32) error { return nil }); err == nil {
+		t.Fatal("expected error reusing an extension opcode")
+	}
+
+	c := newTestCpu(t, `
+total:  wd 0
+        push 40
+        addn 2
+        st total
+        halt
+`, nil)
+
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Heap[1] != 42 {
+		t.Fatalf("expected 42, got %d", c.Heap[1])
+	}
+	if p := opcodes.GetPneumonic(uint32(c.Code[2])); p != "addn" {
+		t.Fatalf("expected disassembly as addn, got %s", p)
+	}
+}
+
+func TestCapabilityNotGranted(t *testing.T) {
+	c := newTestCpu(t, `
+        .requires console
+        sys time
+        halt
+`, StandardSyscalls())
+
+	if err := c.Run(); err == nil {
+		t.Fatal("expected error using time without the capability")
+	}
+
+	c.SetCapabilities(executable.CapConsole | executable.CapTime)
+	c.InstructionPointer = 0
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInputScript(t *testing.T) {
+	source := `
+sum:    wd 0
+read_next:
+        in
+        eof
+        jif finished
+        ld sum
+        add
+        st sum
+        jmp read_next
+finished:
+        ld sum
+        out
+        halt
+`
+	c := newTestCpu(t, source, nil)
+	out := new(bytes.Buffer)
+	c.SetInput(strings.NewReader("1\n 2 \n\n39"), false)
+	c.SetOutput(out)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "42\n" {
+		t.Fatalf("expected output %q, got %q", "42\n", out.String())
+	}
+
+	c = newTestCpu(t, source, nil)
+	c.SetInput(strings.NewReader("1\nabc\n"), false)
+	c.SetOutput(out)
+	if err := c.Run(); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected malformed input error on line 2, got %v", err)
+	}
+}
+
+func TestPrintf(t *testing.T) {
+	c := newTestCpu(t, `
+greeting:   ws  "Result:"
+name:       ws  "kabbit"
+format:     ws  "%s %d, 0x%x %c%c 100%% %s\n"
+        outs greeting
+        push name
+        push 42
+        push 255
+        push 111
+        push 107
+        push greeting
+        printf format
+        halt
+`, nil)
+	out := new(bytes.Buffer)
+	c.SetOutput(out)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Result:kabbit 42, 0xFF ok 100% Result:\n"
+	if out.String() != expected {
+		t.Fatalf("expected output %q, got %q", expected, out.String())
+	}
+	if c.StackPointer != 0 {
+		t.Fatalf("expected empty stack, stack pointer is %d", c.StackPointer)
+	}
+}
+
+func TestPauseResumeStop(t *testing.T) {
+	c := newTestCpu(t, `
+ticks:  wd 0
+tick:
+        minc ticks
+        jmp tick
+`, nil)
+
+	done := make(chan error)
+	go func() {
+		done <- c.Run()
+	}()
+
+	for c.State() != StateRunning {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := c.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if c.State() != StatePaused {
+		t.Fatalf("expected paused, got %s", c.State())
+	}
+
+	// while paused the cpu can be inspected and changed safely
+	ip := c.InstructionPointer
+	c.Heap[1] = -1000000
+	time.Sleep(10 * time.Millisecond)
+	if c.InstructionPointer != ip {
+		t.Fatal("cpu moved while paused")
+	}
+
+	if err := c.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	c.Stop()
+
+	err := <-done
+	if !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected interrupted, got %v", err)
+	}
+	if c.State() != StateStopped {
+		t.Fatalf("expected stopped, got %s", c.State())
+	}
+	if c.Heap[1] >= 0 {
+		t.Fatalf("expected change made while paused to be kept, got %d", c.Heap[1])
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	c := newTestCpu(t, `
+forever:
+        jmp forever
+`, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := c.RunContext(ctx)
+	if !errors.Is(err, ErrInterrupted) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected interrupted by deadline, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	source := `
+count:  wd 0
+loop:
+        push 1
+        minc count
+        jmp loop
+`
+	spin := `
+forever:
+        jmp forever
+`
+	tests := []struct {
+		name   string
+		source string
+		limits Limits
+		kind   error
+	}{
+		{"instructions", source, Limits{MaxInstructions: 100}, ErrInstructionLimit},
+		{"gas", source, Limits{Gas: 50}, ErrOutOfGas},
+		{"stack", source, Limits{MaxStackDepth: 10}, ErrStackLimit},
+		{"heap", source, Limits{MaxHeapSize: 1}, ErrHeapLimit},
+		{"time", spin, Limits{MaxDuration: 20 * time.Millisecond}, ErrTimeLimit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestCpu(t, test.source, nil)
+			c.SetLimits(test.limits)
+
+			err := c.Run()
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || !errors.Is(err, test.kind) {
+				t.Fatalf("expected %v, got %v", test.kind, err)
+			}
+		})
+	}
+
+	c := newTestCpu(t, source, nil)
+	c.SetLimits(Limits{MaxInstructions: 30})
+	err := c.Run()
+	if c.Instructions() != 30 || c.Heap[1] != 10 {
+		t.Fatalf("expected 30 instructions and 10 loops, got %d and %d", c.Instructions(), c.Heap[1])
+	}
+	var fault *Fault
+	if !errors.As(err, &fault) || fault.Kind != ErrInstructionLimit || fault.IP != 0 {
+		t.Fatalf("expected instruction limit fault at IP 0, got %v", err)
+	}
+}
+
+func TestFault(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		kind    error
+		message string
+	}{
+		{"memory", "push 1\nld 5000\nhalt\n", ErrInvalidMemory, "fault at IP 0x0002 (ld 5000): invalid memory location 5000"},
+		{"underflow", "pop\nhalt\n", ErrStackUnderflow, "fault at IP 0x0000 (pop): stack underflow"},
+		{"divide", "push 0\npush 7\ndiv\nhalt\n", ErrDivideByZero, "fault at IP 0x0004 (div): divide by zero"},
+		{"off the end", "push 1\n", ErrInvalidIP, "fault at IP 0x0002: instruction pointer outside code"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestCpu(t, test.source, nil)
+
+			err := c.Run()
+			var fault *Fault
+			if !errors.As(err, &fault) || !errors.Is(err, test.kind) {
+				t.Fatalf("expected %v fault, got %v", test.kind, err)
+			}
+			if err.Error() != test.message {
+				t.Fatalf("expected %q, got %q", test.message, err.Error())
+			}
+		})
+	}
+}
+
+type recordingObserver struct {
+	BaseObserver
+	events []string
+}
+
+func (r *recordingObserver) MemoryWrite(c *Cpu, addr int32, old int32, new int32) {
+	r.events = append(r.events, fmt.Sprintf("write %d %d->%d", addr, old, new))
+}
+
+func (r *recordingObserver) Branch(c *Cpu, from int, to int) {
+	r.events = append(r.events, fmt.Sprintf("branch %d->%d", from, to))
+}
+
+func (r *recordingObserver) IO(c *Cpu, event IOEvent) {
+	r.events = append(r.events, fmt.Sprintf("io %d %q", event.Descriptor, event.Data))
+}
+
+func (r *recordingObserver) Halt(c *Cpu, err error) {
+	r.events = append(r.events, fmt.Sprintf("halt %v", err))
+}
+
+func TestObservers(t *testing.T) {
+	c := newTestCpu(t, `
+count:  wd 2
+loop:
+        mdec count
+        ld count
+        jif loop
+        ld count
+        out
+        halt
+`, nil)
+	c.SetOutput(new(bytes.Buffer))
+
+	first, second := &recordingObserver{}, &recordingObserver{}
+	c.AddObserver(first)
+	c.AddObserver(second)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"write 1 2->1",
+		"branch 4->0",
+		"write 1 1->0",
+		`io 1 "0\n"`,
+		"halt <nil>",
+	}
+	for _, r := range []*recordingObserver{first, second} {
+		if strings.Join(r.events, ", ") != strings.Join(expected, ", ") {
+			t.Fatalf("expected events %q, got %q", expected, r.events)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	c := newTestCpu(t, `
+        spawn worker
+        spawn worker
+        join
+        join
+        ld total
+        out
+        halt
+worker:
+        push 50
+count:
+        minc total
+        dec
+        dup
+        jif count
+        halt
+total:  wd 0
+`, nil)
+	out := new(bytes.Buffer)
+	c.SetOutput(out)
+	c.SetQuantum(3)
+
+	switches := 0
+	last := int32(0)
+	c.AddObserver(&threadWatcher{fn: func(id int32) {
+		if id != last {
+			switches++
+			last = id
+		}
+	}})
+
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "100\n" {
+		t.Fatalf("expected 100, got %q", out.String())
+	}
+	if switches < 10 {
+		t.Fatalf("expected threads to be preempted, only saw %d switches", switches)
+	}
+
+	c = newTestCpu(t, `
+        spawn wait_for_main
+        join
+        halt
+wait_for_main:
+        push 0
+        join
+        halt
+`, nil)
+	err := c.Run()
+	if !errors.Is(err, ErrDeadlock) || !strings.Contains(err.Error(), "thread 1 waiting for thread 0") {
+		t.Fatalf("expected deadlock, got %v", err)
+	}
+}
+
+type threadWatcher struct {
+	BaseObserver
+	fn func(id int32)
+}
+
+func (w *threadWatcher) BeforeInstruction(c *Cpu, ip int, opcode int32, operand int32) {
+	w.fn(c.ThreadID())
+}
+
+func TestSnapshot(t *testing.T) {
+	source := `
+        spawn worker
+        spawn worker
+        join
+        join
+        ld total
+        out
+        halt
+worker:
+        push 50
+count:
+        minc total
+        dec
+        dup
+        jif count
+        halt
+total:  wd 0
+`
+	c := newTestCpu(t, source, nil)
+	c.SetQuantum(3)
+	c.SetLimits(Limits{MaxInstructions: 100})
+	if err := c.Run(); !errors.Is(err, ErrInstructionLimit) {
+		t.Fatalf("expected instruction limit, got %v", err)
+	}
+
+	snapshot, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := snapshot.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	snapshot, err = ReadSnapshot(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestCpu(t, source, nil)
+	restored.SetQuantum(3)
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	restored.SetOutput(out)
+	if err := restored.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "100\n" {
+		t.Fatalf("expected 100, got %q", out.String())
+	}
+
+	data[len(data)/2] ^= 0xFF
+	if _, err := ReadSnapshot(bytes.NewReader(data)); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("expected a bad snapshot, got %v", err)
+	}
+
+	other := newTestCpu(t, "        halt\n", nil)
+	if err := other.Restore(snapshot); !errors.Is(err, ErrSnapshotMismatch) {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	c := newTestCpu(t, "        push 1\n        halt\n", nil)
+	good, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(s *Snapshot)
+	}{
+		{"current thread without threads", func(s *Snapshot) { s.Current = 2 }},
+		{"negative SP", func(s *Snapshot) { s.SP = -1 }},
+		{"negative stack size", func(s *Snapshot) { s.StackSize = -1 }},
+		{"negative thread SP", func(s *Snapshot) {
+			s.Threads = []SnapshotThread{{Joining: -1}, {SP: -1, StackSize: 16, Joining: -1}}
+		}},
+		{"negative thread stack size", func(s *Snapshot) {
+			s.Threads = []SnapshotThread{{Joining: -1}, {StackSize: -1, Joining: -1}}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := *good
+			test.change(&s)
+
+			c := newTestCpu(t, "        push 1\n        halt\n", nil)
+			if err := c.Restore(&s); !errors.Is(err, ErrBadSnapshot) {
+				t.Fatalf("expected a bad snapshot, got %v", err)
+			}
+			if err := c.Run(); err != nil {
+				t.Fatalf("expected the cpu to be left as it was, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRestoreAfterHalt(t *testing.T) {
+	source := `
+        .requires console, fs
+name:   ws "log.txt"
+        push 1
+        open name
+        pop
+        push 1
+        out
+        halt
+        push 2
+        out
+        halt
+`
+	fsys := vfs.NewMemFS()
+	c := newTestCpu(t, source, nil)
+	c.AttachFileSystem(fsys)
+	c.SetOutput(new(bytes.Buffer))
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file left open is closed by the time Run returns
+	suspended, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = newTestCpu(t, source, nil)
+	if err := c.Restore(suspended); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	c.SetOutput(out)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "2\n" {
+		t.Fatalf("expected to carry on after the first halt, got %q", out.String())
+	}
+
+	finished, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newTestCpu(t, source, nil)
+	if err := c.Restore(finished); !errors.Is(err, ErrFinished) {
+		t.Fatalf("expected the finished program to be refused, got %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	c := newTestCpu(t, `
+        push 5
+loop:
+        minc total
+        dec
+        dup
+        jif loop
+        push 99
+        st other
+        push 7
+        st total
+        minc other
+        halt
+total:  wd 0
+other:  wd 0
+`, nil)
+	c.SetHistory(100)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	instructions := c.Instructions()
+	heap := append([]int32{}, c.Heap...)
+
+	steps, err := c.ReverseToWrite(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if steps != 3 || c.InstructionPointer != 16 || c.Heap[1] != 5 || c.Heap[2] != 99 {
+		t.Fatalf("expected to be back at 'st total', got IP %d after %d steps, heap %v", c.InstructionPointer, steps, c.Heap)
+	}
+
+	for c.History() > 0 {
+		if err := c.StepBack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.InstructionPointer != 0 || c.StackPointer != 0 || c.Instructions() != 0 || c.Heap[1] != 0 || c.Heap[2] != 0 {
+		t.Fatalf("expected the starting state, got IP %d, SP %d, heap %v", c.InstructionPointer, c.StackPointer, c.Heap)
+	}
+	if err := c.StepBack(); !errors.Is(err, ErrNoHistory) {
+		t.Fatalf("expected no history, got %v", err)
+	}
+
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Instructions() != instructions || !slices.Equal(c.Heap, heap) {
+		t.Fatalf("expected the same run again, got heap %v", c.Heap)
+	}
+}
+
+func TestPersistentHeap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "runs.heap")
+	source := `
+runs:   wd 0
+        minc runs
+        halt
+`
+	for i := int32(1); i <= 2; i++ {
+		c := newTestCpu(t, source, nil)
+		loaded, err := c.LoadHeap(filename)
+		if err != nil {
+			t.Fatal(err)
+		} else if loaded != (i > 1) {
+			t.Fatalf("run %d: expected loaded to be %v", i, i > 1)
+		}
+		if err := c.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SaveHeap(filename); err != nil {
+			t.Fatal(err)
+		}
+		if c.Heap[1] != i {
+			t.Fatalf("run %d: expected %d runs, got %d", i, i, c.Heap[1])
+		}
+	}
+
+	c := newTestCpu(t, "extra:  wd 0\n"+source, nil)
+	if _, err := c.LoadHeap(filename); !errors.Is(err, ErrLayoutChanged) {
+		t.Fatalf("expected a layout change, got %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	c := newTestCpu(t, `
+total:  wd 0
+loop:
+        minc total
+        jmp loop
+`, nil)
+	c.SetLimits(Limits{MaxInstructions: 11})
+	if err := c.Run(); !errors.Is(err, ErrInstructionLimit) {
+		t.Fatalf("expected instruction limit, got %v", err)
+	}
+	total := c.Heap[1]
+
+	assemble := func(source string) *executable.ExecutableFile {
+		code, err := assembler.NewAssembler(false).Assemble(source)
+		if err != nil {
+			t.Fatalf("unable to assemble: %v", err)
+		}
+		return code.NewExecutableFile("test.kbx")
+	}
+
+	moved := assemble(`
+other:  wd 0
+total:  wd 0
+loop:
+        jmp loop
+`)
+	if err := c.Reload(moved); !errors.Is(err, ErrIncompatibleReload) || c.Executable() == moved {
+		t.Fatalf("expected the moved data label to be refused, got %v", err)
+	}
+
+	// an instruction inserted ahead of the IP in the same block would
+	// leave it on the wrong instruction
+	shifted := assemble(`
+total:  wd 0
+loop:
+        push 1
+        pop
+        minc total
+        jmp loop
+`)
+	if err := c.Reload(shifted); !errors.Is(err, ErrIncompatibleReload) || c.Executable() == shifted {
+		t.Fatalf("expected the shifted instruction to be refused, got %v", err)
+	}
+
+	if err := c.Reload(assemble(`
+total:  wd 0
+extra:  wd 0
+        push 1
+        pop
+loop:
+        minc extra
+        jmp check
+check:
+        ld extra
+        push 5
+        iseq
+        jif done
+        jmp loop
+done:
+        halt
+`)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetLimits(Limits{})
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Heap[1] != total || c.Heap[2] != 5 {
+		t.Fatalf("expected the total kept at %d and extra counted to 5, got heap %v", total, c.Heap)
+	}
+}
+
+func TestBlockDevice(t *testing.T) {
+	source := `
+        .requires disk
+blocks: wd 0
+buf:    ds 128
+        blkcnt
+        st blocks
+        push 42
+        st buf
+        push 1
+        writeblk buf
+        push 0
+        st buf
+        push 1
+        readblk buf
+        halt
+`
+	d, err := disk.Create(filepath.Join(t.TempDir(), "test.img"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	c := newTestCpu(t, source, nil)
+	c.AttachDisk(d)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Heap[1] != 4 {
+		t.Fatalf("expected 4 blocks, got %d", c.Heap[1])
+	}
+	if c.Heap[2] != 42 {
+		t.Fatalf("expected 42 read back from the disk, got %d", c.Heap[2])
+	}
+	block := make([]int32, disk.BlockSize)
+	if err := d.ReadBlock(1, block); err != nil {
+		t.Fatal(err)
+	}
+	if block[0] != 42 {
+		t.Fatalf("expected 42 written to block 1, got %d", block[0])
+	}
+
+	c = newTestCpu(t, source, nil)
+	err = c.Run()
+	if !errors.Is(err, ErrNoDevice) || !strings.HasSuffix(err.Error(), "device not attached: no disk") {
+		t.Fatalf("expected no disk fault, got %v", err)
+	}
+
+	c = newTestCpu(t, `
+        .requires disk
+buf:    ds 128
+        push 4
+        readblk buf
+        halt
+`, nil)
+	c.AttachDisk(d)
+	if err := c.Run(); !errors.Is(err, ErrInvalidOperand) {
+		t.Fatalf("expected invalid block fault, got %v", err)
+	}
+}
+
+// failingFS fails every open with an error that isn't one of the
+// well known kinds
+type failingFS struct{}
+
+func (failingFS) OpenFile(name string, flag int) (vfs.File, error) {
+	return nil, errors.New("disk on fire")
+}
+
+func TestFiles(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	fsys.WriteFile("readonly.txt", []byte("fixed"), 0444)
+
+	c := newTestCpu(t, `
+        .requires fs
+fd:     wd 0
+count:  wd 0
+buf:    ws "hi"
+name:   ws "out.txt"
+        push 1
+        open name
+        st fd
+        ld fd
+        push 2
+        write buf
+        pop
+        ld fd
+        close
+        pop
+        push 0
+        open name
+        st fd
+        push 0
+        st buf
+        ld fd
+        push 3
+        read buf
+        st count
+        ld fd
+        close
+        pop
+        halt
+`, nil)
+	c.AttachFileSystem(fsys)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := fsys.ReadFile("out.txt"); string(data) != "hi" {
+		t.Fatalf("expected %q written, got %q", "hi", string(data))
+	}
+	if c.Heap[1] != firstDescriptor || c.Heap[2] != 2 || c.Heap[3] != 'h' {
+		t.Fatalf("expected descriptor 3 and 2 bytes read back, got %d, %d and %d", c.Heap[1], c.Heap[2], c.Heap[3])
+	}
+
+	tests := []struct {
+		name   string
+		fsys   vfs.FileSystem
+		source string
+		code   int32
+	}{
+		{"not found", fsys, "push 0\nopen missing\n", ErrCodeNotFound},
+		{"permission", fsys, "push 1\nopen readonly\n", ErrCodePermission},
+		{"bad descriptor", fsys, "push 99\nclose\n", ErrCodeBadDescriptor},
+		{"unknown mode", fsys, "push 9\nopen readonly\n", ErrCodeInvalid},
+		{"negative count", fsys, "push 0\nopen readonly\npush 0\ndec\nread buf\n", ErrCodeInvalid},
+		{"too many open", fsys, strings.Repeat("push 0\nopen readonly\npop\n", MaxDescriptors) + "push 0\nopen readonly\n", ErrCodeTooManyOpen},
+		{"io", failingFS{}, "push 0\nopen readonly\n", ErrCodeIO},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestCpu(t, `
+        .requires fs
+result:     wd 0
+missing:    ws "missing.txt"
+readonly:   ws "readonly.txt"
+buf:        ds 16
+`+test.source+`
+        st result
+        halt
+`, nil)
+			c.AttachFileSystem(test.fsys)
+			if err := c.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if c.Heap[1] != test.code {
+				t.Fatalf("expected %d, got %d", test.code, c.Heap[1])
+			}
+		})
+	}
+}
+
+// freeAddress returns a loopback address that nothing is listening on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+	return address
+}
+
+func newSocketCpu(t *testing.T, address string, source string) *Cpu {
+	t.Helper()
+
+	c := newTestCpu(t, fmt.Sprintf(`
+        .requires net
+result: wd 0
+count:  wd 0
+buf:    ds 16
+addr:   ws "%s"
+%s
+        st result
+        halt
+`, address, source), nil)
+	c.EnableNetwork(true)
+	return c
+}
+
+func TestSockets(t *testing.T) {
+	t.Run("listen and accept", func(t *testing.T) {
+		address := freeAddress(t)
+		c := newSocketCpu(t, address, `
+        listen addr
+        accept
+        dup
+        push 16
+        recv buf
+        st count
+        close
+`)
+
+		done := make(chan error)
+		go func() {
+			done <- c.Run()
+		}()
+
+		var conn net.Conn
+		var err error
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial("tcp", address); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if c.Heap[1] != 0 || c.Heap[2] != 5 || c.Heap[3] != 'h' {
+			t.Fatalf("expected 5 bytes received and a clean close, got %d, %d and %d", c.Heap[2], c.Heap[3], c.Heap[1])
+		}
+	})
+
+	t.Run("connect and send", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		received := make(chan string)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				received <- err.Error()
+				return
+			}
+			defer conn.Close()
+			data, _ := io.ReadAll(conn)
+			received <- string(data)
+		}()
+
+		c := newSocketCpu(t, l.Addr().String(), `
+        push 104
+        st buf
+        connect addr
+        dup
+        push 1
+        send buf
+        st count
+        close
+`)
+		if err := c.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if data := <-received; data != "h" {
+			t.Fatalf("expected %q sent, got %q", "h", data)
+		}
+		if c.Heap[2] != 1 {
+			t.Fatalf("expected 1 byte sent, got %d", c.Heap[2])
+		}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		name    string
+		address string
+		source  string
+		code    int32
+	}{
+		{"not loopback", "10.0.0.1:80", "connect addr", ErrCodePermission},
+		{"bad address", "no port", "connect addr", ErrCodeInvalid},
+		{"refused", freeAddress(t), "connect addr", ErrCodeRefused},
+		{"in use", l.Addr().String(), "listen addr", ErrCodeAddressInUse},
+		{"accept on a bad descriptor", "", "push 3\naccept", ErrCodeBadDescriptor},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newSocketCpu(t, test.address, test.source)
+			if err := c.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if c.Heap[1] != test.code {
+				t.Fatalf("expected %d, got %d", test.code, c.Heap[1])
+			}
+		})
+	}
+}
+
+func TestSocketInterrupted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// accept connections but never send anything, so recv blocks
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		address string
+		source  string
+	}{
+		{"accept", freeAddress(t), "listen addr\naccept"},
+		{"recv", l.Addr().String(), "connect addr\npush 16\nrecv buf"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newSocketCpu(t, test.address, test.source)
+
+			done := make(chan error)
+			go func() {
+				done <- c.Run()
+			}()
+
+			for c.State() != StateRunning {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(2 * pollInterval)
+			c.Stop()
+
+			if err := <-done; !errors.Is(err, ErrInterrupted) {
+				t.Fatalf("expected interrupted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestArgs(t *testing.T) {
+	c := newTestCpu(t, `
+argc:   wd 0
+envc:   wd 0
+len1:   wd 0
+len2:   wd 0
+len3:   wd 0
+len4:   wd 0
+arg:    ds 8
+short:  ds 4
+env:    ds 10
+        argc
+        st argc
+        envc
+        st envc
+        push 1
+        push 8
+        argv arg
+        st len1
+        push 2
+        push 4
+        argv short
+        st len2
+        push 3
+        push 8
+        argv arg
+        st len3
+        push 0
+        push 10
+        envv env
+        st len4
+        halt
+`, nil)
+	c.SetArgs([]string{"test.kbx", "hi", "truncated"})
+	c.SetEnv([]string{"MODE=fast"})
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	readString := func(addr int) string {
+		var sb strings.Builder
+		for ; c.Heap[addr] != 0; addr++ {
+			sb.WriteByte(byte(c.Heap[addr]))
+		}
+		return sb.String()
+	}
+
+	if c.Heap[1] != 3 || c.Heap[2] != 1 {
+		t.Fatalf("expected 3 arguments and 1 variable, got %d and %d", c.Heap[1], c.Heap[2])
+	}
+	if s := readString(7); s != "hi" || c.Heap[3] != 2 {
+		t.Fatalf("expected %q of length 2, got %q of length %d", "hi", s, c.Heap[3])
+	}
+	if s := readString(15); s != "tru" || c.Heap[4] != 9 {
+		t.Fatalf("expected %q truncated from length 9, got %q of length %d", "tru", s, c.Heap[4])
+	}
+	if c.Heap[5] != ErrCodeNotFound {
+		t.Fatalf("expected %d for an index out of range, got %d", ErrCodeNotFound, c.Heap[5])
+	}
+	if s := readString(19); s != "MODE=fast" || c.Heap[6] != 9 {
+		t.Fatalf("expected %q of length 9, got %q of length %d", "MODE=fast", s, c.Heap[6])
+	}
+}
@@ -0,0 +1,193 @@
+package cpu
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"syscall"
+
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// Error codes pushed by the file, socket and message instructions in place of a
+// descriptor or byte count. All of them are negative so a program can test
+// for failure with a single comparison.
+const (
+	ErrCodeNotFound      = -1
+	ErrCodePermission    = -2
+	ErrCodeBadDescriptor = -3
+	ErrCodeInvalid       = -4
+	ErrCodeTooManyOpen   = -5
+	ErrCodeIO            = -6
+	ErrCodeRefused       = -7
+	ErrCodeAddressInUse  = -8
+	ErrCodeMailboxFull   = -9
+)
+
+// MaxDescriptors is the number of files and sockets a program can have
+// open at once
+const MaxDescriptors = 16
+
+// firstDescriptor is the lowest descriptor handed out; 0-2 are reserved
+// for the console
+const firstDescriptor = 3
+
+// descriptorOp handles the instructions that work on any open descriptor,
+// whether it's a file or a socket
+func (c *Cpu) descriptorOp(opcode int32, param int32) error {
+	if opcode == opcodes.CLOSE {
+		fd, err := c.pop()
+		if err != nil {
+			return err
+		}
+
+		return c.push(c.closeDescriptor(fd))
+	}
+
+	count, err := c.pop()
+	if err != nil {
+		return err
+	}
+	fd, err := c.pop()
+	if err != nil {
+		return err
+	}
+
+	if count < 0 {
+		return c.push(ErrCodeInvalid)
+	} else if err := c.checkRange(param, count); err != nil {
+		return err
+	}
+
+	var result int32
+	switch opcode {
+	case opcodes.READ, opcodes.RECV:
+		result, err = c.readDescriptor(fd, param, count)
+	case opcodes.WRITE, opcodes.SEND:
+		result, err = c.writeDescriptor(fd, param, count)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.push(result)
+}
+
+// readDescriptor reads up to count bytes into the heap, one byte per word
+func (c *Cpu) readDescriptor(fd int32, addr int32, count int32) (int32, error) {
+	r, ok := c.descriptors[fd].(io.Reader)
+	if !ok {
+		return ErrCodeBadDescriptor, nil
+	}
+
+	buf := make([]byte, count)
+	n := 0
+	err := c.blocking(r, alwaysRestart, func() error {
+		var err error
+		n, err = r.Read(buf)
+		return err
+	})
+	if isControl(err) {
+		return 0, err
+	} else if err != nil && err != io.EOF {
+		return errorCode(err), nil
+	}
+
+	for i := 0; i < n; i++ {
+		c.store(addr+int32(i), int32(buf[i]))
+	}
+	if len(c.observers) > 0 {
+		c.notifyIO(IOEvent{Opcode: c.Code[c.InstructionPointer], Descriptor: fd, Data: buf[:n]})
+	}
+
+	return int32(n), nil
+}
+
+// writeDescriptor writes the low byte of count words from the heap
+func (c *Cpu) writeDescriptor(fd int32, addr int32, count int32) (int32, error) {
+	w, ok := c.descriptors[fd].(io.Writer)
+	if !ok {
+		return ErrCodeBadDescriptor, nil
+	}
+
+	buf := make([]byte, count)
+	for i := range buf {
+		buf[i] = byte(c.load(addr + int32(i)))
+	}
+
+	// once some of the data has gone it can't be taken back, so a pause
+	// has to wait for the rest
+	written := 0
+	canRestart := func() bool { return written == 0 }
+	err := c.blocking(w, canRestart, func() error {
+		n, err := w.Write(buf[written:])
+		written += n
+		return err
+	})
+	if len(c.observers) > 0 && written > 0 {
+		c.notifyIO(IOEvent{Opcode: c.Code[c.InstructionPointer], Descriptor: fd, Data: buf[:written]})
+	}
+	if isControl(err) {
+		return 0, err
+	} else if err != nil {
+		return errorCode(err), nil
+	}
+
+	return int32(written), nil
+}
+
+func (c *Cpu) closeDescriptor(fd int32) int32 {
+	d, ok := c.descriptors[fd]
+	if !ok {
+		return ErrCodeBadDescriptor
+	}
+
+	delete(c.descriptors, fd)
+	if err := d.Close(); err != nil {
+		return errorCode(err)
+	}
+
+	return 0
+}
+
+// closeDescriptors releases everything the program left open
+func (c *Cpu) closeDescriptors() {
+	for fd, d := range c.descriptors {
+		d.Close()
+		delete(c.descriptors, fd)
+	}
+}
+
+func (c *Cpu) nextDescriptor() int32 {
+	if c.descriptors == nil {
+		c.descriptors = make(map[int32]io.Closer)
+	}
+
+	for fd := int32(firstDescriptor); fd < firstDescriptor+MaxDescriptors; fd++ {
+		if _, ok := c.descriptors[fd]; !ok {
+			return fd
+		}
+	}
+
+	return ErrCodeTooManyOpen
+}
+
+// errorCode maps a Go error onto the codes visible to programs
+func errorCode(err error) int32 {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrCodeNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return ErrCodePermission
+	case errors.Is(err, fs.ErrInvalid):
+		return ErrCodeInvalid
+	case errors.Is(err, fs.ErrClosed):
+		return ErrCodeBadDescriptor
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrCodeRefused
+	case errors.Is(err, syscall.EADDRINUSE):
+		return ErrCodeAddressInUse
+	default:
+		return ErrCodeIO
+	}
+}
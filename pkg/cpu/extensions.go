@@ -0,0 +1,65 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// ExtensionFunc executes an extension instruction. operand is 0 for
+// instructions without one. Values are exchanged with the program through
+// Pop and Push.
+type ExtensionFunc func(c *Cpu, operand int32) error
+
+var extensionLock sync.RWMutex
+var extensionHandlers map[int32]ExtensionFunc = map[int32]ExtensionFunc{}
+
+// RegisterExtension claims an opcode from the extension range for a new
+// instruction. The pneumonic is added to the shared opcode table so the
+// assembler and disassembler know about it, and every cpu runs handler
+// when it reaches the opcode.
+func RegisterExtension(pneumonic string, opcode uint32, param opcodes.OperandType, handler ExtensionFunc) error {
+	if handler == nil {
+		return errors.New(fmt.Sprintf("extension '%s' requires a handler", pneumonic))
+	}
+
+	err := opcodes.RegisterExtension(opcodes.Instruction{
+		Pneumonic: pneumonic,
+		Opcode:    opcode,
+		Param:     param,
+	})
+	if err != nil {
+		return err
+	}
+
+	extensionLock.Lock()
+	defer extensionLock.Unlock()
+
+	extensionHandlers[int32(opcode)] = handler
+	return nil
+}
+
+// UnregisterExtension removes the instruction registered for opcode from
+// both the opcode table and the cpu, so the opcode can be claimed again
+func UnregisterExtension(opcode uint32) {
+	opcodes.UnregisterExtension(opcode)
+
+	extensionLock.Lock()
+	defer extensionLock.Unlock()
+
+	delete(extensionHandlers, int32(opcode))
+}
+
+func (c *Cpu) extension(opcode int32, param int32) error {
+	extensionLock.RLock()
+	handler, ok := extensionHandlers[opcode]
+	extensionLock.RUnlock()
+
+	if !ok {
+		return ErrInvalidInstruction
+	}
+
+	return handler(c, param)
+}
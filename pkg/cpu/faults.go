@@ -0,0 +1,114 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// Fault kinds, for use with errors.Is on the error returned by Step or Run
+var (
+	ErrStackUnderflow     = errors.New("stack underflow")
+	ErrStackOverflow      = errors.New("stack overflow")
+	ErrInvalidMemory      = errors.New("invalid memory location")
+	ErrInvalidInstruction = errors.New("invalid instruction")
+	ErrInvalidJump        = errors.New("invalid jump address")
+	ErrInvalidIP          = errors.New("instruction pointer outside code")
+	ErrDivideByZero       = errors.New("divide by zero")
+	ErrInvalidOperand     = errors.New("invalid operand")
+	ErrCapability         = errors.New("capability not granted")
+	ErrNoDevice           = errors.New("device not attached")
+	ErrMalformedInput     = errors.New("malformed input")
+	ErrUnknownSyscall     = errors.New("unknown syscall")
+
+	// ErrInstructionFailed is the kind given to errors that don't match
+	// any other, such as those returned by syscall and extension handlers
+	ErrInstructionFailed = errors.New("instruction failed")
+)
+
+// faultKinds are the kinds a Fault can have. A limit reached while an
+// instruction runs, including the instruction and gas limits, gives a
+// Fault wrapping the LimitError. A limit reached outside any instruction
+// doesn't: the heap limit checked as Run starts, and the time limit
+// running out between instructions, come back from Run as a bare
+// LimitError, the same way ErrInterrupted does.
+var faultKinds = []error{
+	ErrStackUnderflow, ErrStackOverflow, ErrInvalidMemory, ErrInvalidInstruction,
+	ErrInvalidJump, ErrInvalidIP, ErrDivideByZero, ErrInvalidOperand, ErrCapability,
+	ErrNoDevice, ErrMalformedInput, ErrUnknownSyscall, ErrDeadlock, ErrDiverged,
+	ErrStackLimit, ErrHeapLimit, ErrTimeLimit, ErrInstructionLimit, ErrOutOfGas,
+}
+
+// Fault is the error returned when an instruction fails. It records where
+// the cpu was, and matches both its Kind and the underlying error with
+// errors.Is and errors.As.
+type Fault struct {
+	Kind    error
+	IP      int
+	Opcode  int32
+	Operand int32
+	SP      int
+	Err     error
+}
+
+func (f *Fault) Error() string {
+	msg := f.Kind.Error()
+	if f.Err != nil {
+		msg = f.Err.Error()
+	}
+
+	if f.Kind == ErrInvalidIP {
+		return fmt.Sprintf("fault at IP 0x%04X: %s", f.IP, msg)
+	}
+	return fmt.Sprintf("fault at IP 0x%04X (%s): %s", f.IP, f.Instruction(), msg)
+}
+
+func (f *Fault) Unwrap() []error {
+	if f.Err == nil {
+		return []error{f.Kind}
+	}
+	return []error{f.Kind, f.Err}
+}
+
+// Instruction returns the faulting instruction as it would be written in
+// assembly
+func (f *Fault) Instruction() string {
+	instr, err := opcodes.GetInstructionByOpcode(uint32(f.Opcode))
+	if err != nil {
+		return fmt.Sprintf("opcode 0x%X", f.Opcode)
+	}
+
+	if instr.Param == opcodes.NONE {
+		return instr.Pneumonic
+	}
+	return fmt.Sprintf("%s %d", instr.Pneumonic, f.Operand)
+}
+
+// newFault wraps err with the state of the cpu at the start of the
+// instruction that failed
+func (c *Cpu) newFault(err error, ip int, sp int) *Fault {
+	f := &Fault{Kind: ErrInstructionFailed, IP: ip, SP: sp, Err: err}
+	for _, kind := range faultKinds {
+		if errors.Is(err, kind) {
+			f.Kind = kind
+			break
+		}
+	}
+
+	if ip >= 0 && ip+1 < len(c.Code) {
+		f.Opcode = c.Code[ip]
+		f.Operand = c.Code[ip+1]
+	}
+
+	return f
+}
+
+// checkAddress makes sure addr is on the heap
+func (c *Cpu) checkAddress(addr int32) error {
+	if addr < 0 || int(addr) >= c.heapSize {
+		return fmt.Errorf("%w %d", ErrInvalidMemory, addr)
+	}
+
+	return nil
+}
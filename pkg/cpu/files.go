@@ -0,0 +1,72 @@
+package cpu
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/vfs"
+)
+
+// Modes popped by OPEN
+const (
+	OpenRead      = 0 // read an existing file
+	OpenWrite     = 1 // create or truncate, then write
+	OpenAppend    = 2 // create if needed, then write at the end
+	OpenReadWrite = 3 // read and write an existing file
+)
+
+var openFlags = map[int32]int{
+	OpenRead:      os.O_RDONLY,
+	OpenWrite:     os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	OpenAppend:    os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	OpenReadWrite: os.O_RDWR,
+}
+
+// AttachFileSystem gives the program access to fsys through the file
+// instructions. Passing nil detaches the current file system.
+func (c *Cpu) AttachFileSystem(fsys vfs.FileSystem) {
+	c.fileSystem = fsys
+}
+
+func (c *Cpu) openOp(param int32) error {
+	if err := c.require(executable.CapFS); err != nil {
+		return err
+	}
+
+	if c.fileSystem == nil {
+		return fmt.Errorf("%w: no file system", ErrNoDevice)
+	}
+
+	mode, err := c.pop()
+	if err != nil {
+		return err
+	}
+
+	name, err := c.readString(param)
+	if err != nil {
+		return err
+	}
+
+	return c.push(c.openFile(name, mode))
+}
+
+func (c *Cpu) openFile(name string, mode int32) int32 {
+	flag, ok := openFlags[mode]
+	if !ok {
+		return ErrCodeInvalid
+	}
+
+	fd := c.nextDescriptor()
+	if fd < 0 {
+		return fd
+	}
+
+	f, err := c.fileSystem.OpenFile(name, flag)
+	if err != nil {
+		return errorCode(err)
+	}
+
+	c.descriptors[fd] = f
+	return fd
+}
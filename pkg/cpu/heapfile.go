@@ -0,0 +1,84 @@
+package cpu
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// heapFileMagic is "KBHP"
+const heapFileMagic = 0x4B424850
+
+const heapFileVersion = 1
+
+var (
+	ErrBadHeapFile   = errors.New("invalid heap file")
+	ErrLayoutChanged = errors.New("heap file was saved by a program with a different data layout")
+)
+
+// LoadHeap replaces the heap with one saved by SaveHeap, so a program can
+// keep its data from one run to the next. It returns false, and leaves
+// the heap alone, if the file doesn't exist yet. The file must have been
+// saved by a program with the same layout (see
+// ExecutableFile.LayoutFingerprint).
+func (c *Cpu) LoadHeap(filename string) (bool, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	const headerSize = 8 + sha256.Size + 4
+	if len(data) < headerSize+4 {
+		return false, fmt.Errorf("%s: %w: too short", filename, ErrBadHeapFile)
+	} else if executable.Endian.Uint32(data) != heapFileMagic {
+		return false, fmt.Errorf("%s: %w: not a heap file", filename, ErrBadHeapFile)
+	} else if version := executable.Endian.Uint32(data[4:]); version != heapFileVersion {
+		return false, fmt.Errorf("%s: %w: version %d isn't supported", filename, ErrBadHeapFile, version)
+	}
+
+	body, sum := data[:len(data)-4], executable.Endian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return false, fmt.Errorf("%s: %w: checksum doesn't match", filename, ErrBadHeapFile)
+	}
+
+	fingerprint := c.file.LayoutFingerprint()
+	if !bytes.Equal(body[8:8+sha256.Size], fingerprint[:]) {
+		return false, fmt.Errorf("%s: %w", filename, ErrLayoutChanged)
+	}
+
+	words := executable.Endian.Uint32(body[8+sha256.Size:])
+	if int(words) != len(c.Heap) || len(body) != headerSize+int(words)*4 {
+		return false, fmt.Errorf("%s: %w: expected %d words", filename, ErrBadHeapFile, len(c.Heap))
+	}
+	binary.Read(bytes.NewReader(body[headerSize:]), executable.Endian, c.Heap)
+
+	return true, nil
+}
+
+// SaveHeap writes the heap to a file for LoadHeap. The file is replaced
+// in one step, so it's never left half written.
+func (c *Cpu) SaveHeap(filename string) error {
+	fingerprint := c.file.LayoutFingerprint()
+
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, executable.Endian, uint32(heapFileMagic))
+		binary.Write(buf, executable.Endian, uint32(heapFileVersion))
+		buf.Write(fingerprint[:])
+		binary.Write(buf, executable.Endian, uint32(len(c.Heap)))
+		binary.Write(buf, executable.Endian, c.Heap)
+		binary.Write(buf, executable.Endian, crc32.ChecksumIEEE(buf.Bytes()))
+
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
@@ -0,0 +1,183 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultHistory is the number of steps kept by kabv --history when no
+// size is given
+const DefaultHistory = 10000
+
+var ErrNoHistory = errors.New("no history")
+
+// wordWrite is a stack or heap word an instruction overwrote
+type wordWrite struct {
+	words []int32
+	index int32
+	old   int32
+	heap  bool
+}
+
+// undoStep is what's needed to take back one instruction
+type undoStep struct {
+	ip           int
+	sp           int
+	stack        []int32
+	current      int32
+	threads      []thread
+	slice        int
+	reschedule   bool
+	halted       bool
+	eof          bool
+	inputLine    int
+	instructions int64
+	gasUsed      int64
+	writes       []wordWrite
+}
+
+// history is a ring of the most recent steps
+type history struct {
+	steps []undoStep
+	head  int
+	count int
+}
+
+// SetHistory keeps enough of a record of the last n instructions for
+// StepBack to undo them. Zero turns the record off. Input read and output
+// written aren't taken back, and a cpu sharing its heap with other cores
+// shouldn't keep a history, as undoing would overwrite their changes.
+func (c *Cpu) SetHistory(n int) {
+	if n <= 0 {
+		c.history = nil
+		return
+	}
+
+	c.history = &history{steps: make([]undoStep, n)}
+}
+
+// History returns the number of instructions that can be stepped back
+func (c *Cpu) History() int {
+	if c.history == nil {
+		return 0
+	}
+
+	return c.history.count
+}
+
+// StepBack undoes the last instruction. The cpu mustn't be running.
+func (c *Cpu) StepBack() error {
+	if c.State() == StateRunning {
+		return ErrNotPaused
+	} else if c.History() == 0 {
+		return ErrNoHistory
+	}
+
+	c.undo(c.history.pop())
+	return nil
+}
+
+// ReverseToWrite steps back to the last instruction that wrote to the
+// heap word at addr, leaving the cpu about to run it again. It returns the
+// number of instructions stepped back. If no instruction in the history
+// wrote there the cpu isn't moved.
+func (c *Cpu) ReverseToWrite(addr int32) (int, error) {
+	if c.State() == StateRunning {
+		return 0, ErrNotPaused
+	} else if c.History() == 0 {
+		return 0, ErrNoHistory
+	}
+
+	steps := c.history.lastWrite(addr)
+	if steps == 0 {
+		return 0, fmt.Errorf("%w of a write to %d", ErrNoHistory, addr)
+	}
+
+	for i := 0; i < steps; i++ {
+		c.undo(c.history.pop())
+	}
+	return steps, nil
+}
+
+// record starts the undo step for the instruction about to run
+func (c *Cpu) record() {
+	step := c.history.push()
+	step.ip, step.sp, step.stack = c.InstructionPointer, c.StackPointer, c.Stack
+	step.current, step.slice, step.reschedule = c.current, c.slice, c.reschedule
+	step.halted, step.eof, step.inputLine = c.halted, c.console.eof, c.console.line
+	step.instructions, step.gasUsed = c.instructions, c.gasUsed
+	step.writes = step.writes[:0]
+
+	step.threads = step.threads[:0]
+	for _, t := range c.threads {
+		step.threads = append(step.threads, *t)
+	}
+}
+
+// recordWrite notes a word the running instruction is about to overwrite
+func (c *Cpu) recordWrite(words []int32, index int32, heap bool) {
+	step := c.history.top()
+	step.writes = append(step.writes, wordWrite{words: words, index: index, old: words[index], heap: heap})
+}
+
+func (c *Cpu) undo(step *undoStep) {
+	for i := len(step.writes) - 1; i >= 0; i-- {
+		w := step.writes[i]
+		w.words[w.index] = w.old
+	}
+
+	c.InstructionPointer, c.StackPointer, c.Stack = step.ip, step.sp, step.stack
+	c.current, c.slice, c.reschedule = step.current, step.slice, step.reschedule
+	c.halted, c.console.eof, c.console.line = step.halted, step.eof, step.inputLine
+	c.instructions, c.gasUsed = step.instructions, step.gasUsed
+
+	if len(step.threads) == 0 {
+		c.threads = nil
+		return
+	}
+	c.threads = c.threads[:len(step.threads)]
+	for i := range step.threads {
+		t := step.threads[i]
+		c.threads[i] = &t
+	}
+}
+
+func (h *history) push() *undoStep {
+	index := (h.head + h.count) % len(h.steps)
+	if h.count < len(h.steps) {
+		h.count++
+	} else {
+		h.head = (h.head + 1) % len(h.steps)
+	}
+
+	return &h.steps[index]
+}
+
+func (h *history) top() *undoStep {
+	return &h.steps[(h.head+h.count-1)%len(h.steps)]
+}
+
+func (h *history) pop() *undoStep {
+	step := h.top()
+	h.count--
+	return step
+}
+
+// discard drops the step for an instruction that's going to run again
+func (h *history) discard() {
+	h.count--
+}
+
+// lastWrite returns how many steps back the last write to addr is, or 0
+func (h *history) lastWrite(addr int32) int {
+	for i := 1; i <= h.count; i++ {
+		step := &h.steps[(h.head+h.count-i)%len(h.steps)]
+		for _, w := range step.writes {
+			if w.heap && w.index == addr {
+				return i
+			}
+		}
+	}
+
+	return 0
+}
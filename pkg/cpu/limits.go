@@ -0,0 +1,166 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// Limits caps the resources a program can use. A zero value for any
+// field means no limit.
+type Limits struct {
+	MaxInstructions int64
+	MaxDuration     time.Duration
+	MaxStackDepth   int // in words
+	MaxHeapSize     int // in words
+
+	// Gas turns on metering. Each instruction is charged its cost from
+	// GasCosts, or DefaultGasCosts if that's nil, and the program stops
+	// once the total would go over Gas. Opcodes without a cost are
+	// charged 1.
+	Gas      int64
+	GasCosts map[int32]int64
+}
+
+// Errors matched by a LimitError
+var (
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrTimeLimit        = errors.New("time limit exceeded")
+	ErrStackLimit       = errors.New("stack limit exceeded")
+	ErrHeapLimit        = errors.New("heap limit exceeded")
+	ErrOutOfGas         = errors.New("out of gas")
+)
+
+// LimitError is returned when a program goes over one of its limits. Use
+// errors.Is with ErrInstructionLimit and friends to tell which.
+type LimitError struct {
+	Kind  error
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s (limit %d)", e.Kind, e.Limit)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Kind
+}
+
+// DefaultGasCosts charges more for instructions that reach outside the
+// cpu than for those that just shuffle the stack
+func DefaultGasCosts() map[int32]int64 {
+	return map[int32]int64{
+		opcodes.MUL:      3,
+		opcodes.DIV:      5,
+		opcodes.OUT:      10,
+		opcodes.IN:       10,
+		opcodes.OUTS:     10,
+		opcodes.PRINTF:   20,
+		opcodes.SYS:      50,
+		opcodes.READBLK:  100,
+		opcodes.WRITEBLK: 100,
+		opcodes.OPEN:     100,
+		opcodes.READ:     50,
+		opcodes.WRITE:    50,
+		opcodes.CLOSE:    20,
+		opcodes.LISTEN:   100,
+		opcodes.ACCEPT:   100,
+		opcodes.CONNECT:  100,
+		opcodes.SEND:     50,
+		opcodes.RECV:     50,
+		opcodes.MSEND:    50,
+		opcodes.MRECV:    50,
+		opcodes.CAS:      2,
+		opcodes.FETCHADD: 2,
+	}
+}
+
+// SetLimits replaces the cpu's limits
+func (c *Cpu) SetLimits(limits Limits) {
+	c.limits = limits
+	if c.limits.Gas > 0 && c.limits.GasCosts == nil {
+		c.limits.GasCosts = DefaultGasCosts()
+	}
+
+	c.stackLimit = c.stackSize
+	if limits.MaxStackDepth > 0 && limits.MaxStackDepth < c.stackSize {
+		c.stackLimit = limits.MaxStackDepth
+	}
+
+	// a cpu built by NewLimitedCpu only has as much stack as its first
+	// limits allowed
+	if c.threads == nil && len(c.Stack) < c.stackLimit {
+		stack := make([]int32, c.stackLimit)
+		copy(stack, c.Stack)
+		c.Stack = stack
+	}
+}
+
+func (c *Cpu) Limits() Limits {
+	return c.limits
+}
+
+// GasUsed returns the gas charged so far
+func (c *Cpu) GasUsed() int64 {
+	return c.gasUsed
+}
+
+// charge checks the instruction and gas limits before an instruction runs
+func (c *Cpu) charge(opcode int32) error {
+	if c.limits.MaxInstructions > 0 && c.instructions >= c.limits.MaxInstructions {
+		return &LimitError{Kind: ErrInstructionLimit, Limit: c.limits.MaxInstructions}
+	}
+
+	if c.limits.Gas > 0 {
+		cost, ok := c.limits.GasCosts[opcode]
+		if !ok {
+			cost = 1
+		}
+
+		if c.gasUsed+cost > c.limits.Gas {
+			return &LimitError{Kind: ErrOutOfGas, Limit: c.limits.Gas}
+		}
+		c.gasUsed += cost
+	}
+
+	return nil
+}
+
+// CheckFile makes sure file fits within the limits before a cpu is built
+// for it, since building one allocates the heap its header asks for. The
+// stack isn't checked, as NewLimitedCpu only allocates what MaxStackDepth
+// allows.
+func (l Limits) CheckFile(file *executable.ExecutableFile) error {
+	if l.MaxHeapSize > 0 && int64(file.Header.HeapSize) > int64(l.MaxHeapSize) {
+		return &LimitError{Kind: ErrHeapLimit, Limit: int64(l.MaxHeapSize)}
+	}
+
+	return nil
+}
+
+func (c *Cpu) checkHeapLimit() error {
+	if c.limits.MaxHeapSize > 0 && len(c.Heap) > c.limits.MaxHeapSize {
+		return &LimitError{Kind: ErrHeapLimit, Limit: int64(c.limits.MaxHeapSize)}
+	}
+
+	return nil
+}
+
+// startTimeLimit stops the cpu once it has run for MaxDuration. The
+// returned function cancels the timer.
+func (c *Cpu) startTimeLimit() func() {
+	if c.limits.MaxDuration <= 0 {
+		return func() {}
+	}
+
+	timer := time.AfterFunc(c.limits.MaxDuration, func() {
+		c.stop(&LimitError{Kind: ErrTimeLimit, Limit: int64(c.limits.MaxDuration / time.Millisecond)})
+	})
+
+	return func() {
+		timer.Stop()
+	}
+}
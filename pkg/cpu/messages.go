@@ -0,0 +1,119 @@
+package cpu
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// Message is a block of words sent from one cpu to another
+type Message struct {
+	From  int32
+	Words []int32
+}
+
+// Mailboxes carries messages between cpus that know each other by
+// address. The actor package provides one.
+type Mailboxes interface {
+	// Send queues words for the cpu at address to without waiting, and
+	// returns 0 or one of the ErrCode values
+	Send(from int32, to int32, words []int32) int32
+
+	// Receive waits up to timeout for a message to address id
+	Receive(id int32, timeout time.Duration) (Message, bool)
+}
+
+// AttachMailbox gives the cpu an address that other cpus sharing boxes
+// can send to
+func (c *Cpu) AttachMailbox(address int32, boxes Mailboxes) {
+	c.address = address
+	c.mailboxes = boxes
+}
+
+// Address returns the cpu's mailbox address
+func (c *Cpu) Address() int32 {
+	return c.address
+}
+
+func (c *Cpu) messageOp(opcode int32, param int32) error {
+	if err := c.require(executable.CapMsg); err != nil {
+		return err
+	}
+
+	if c.mailboxes == nil {
+		return fmt.Errorf("%w: no mailbox", ErrNoDevice)
+	}
+
+	switch opcode {
+	case opcodes.MSELF:
+		return c.push(c.address)
+	case opcodes.MSEND:
+		count, err := c.pop()
+		if err != nil {
+			return err
+		}
+		to, err := c.pop()
+		if err != nil {
+			return err
+		}
+
+		if count < 0 {
+			return c.push(ErrCodeInvalid)
+		} else if err := c.checkRange(param, count); err != nil {
+			return err
+		}
+
+		words := make([]int32, count)
+		for i := range words {
+			words[i] = c.load(param + int32(i))
+		}
+
+		result := c.mailboxes.Send(c.address, to, words)
+		if len(c.observers) > 0 && result == 0 {
+			c.notifyIO(IOEvent{Opcode: opcode, Descriptor: to})
+		}
+		return c.push(result)
+	case opcodes.MRECV:
+		size, err := c.pop()
+		if err != nil {
+			return err
+		}
+
+		if size < 0 {
+			if err := c.push(ErrCodeInvalid); err != nil {
+				return err
+			}
+			return c.push(ErrCodeInvalid)
+		} else if err := c.checkRange(param, size); err != nil {
+			return err
+		}
+
+		var msg Message
+		for {
+			if err := c.waitCheck(true); err != nil {
+				return err
+			}
+
+			var ok bool
+			if msg, ok = c.mailboxes.Receive(c.address, pollInterval); ok {
+				break
+			}
+		}
+
+		for i := 0; i < len(msg.Words) && i < int(size); i++ {
+			c.store(param+int32(i), msg.Words[i])
+		}
+		if len(c.observers) > 0 {
+			c.notifyIO(IOEvent{Opcode: opcode, Descriptor: msg.From})
+		}
+
+		if err := c.push(msg.From); err != nil {
+			return err
+		}
+		return c.push(int32(len(msg.Words)))
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package cpu
+
+import "errors"
+
+// ErrDiverged is the fault kind for a replayed program that asks for a
+// value other than the one recorded next
+var ErrDiverged = errors.New("replay diverged")
+
+// ValueKind says where a value the program can't predict came from
+type ValueKind int
+
+const (
+	ValueInput ValueKind = iota
+	ValueTime
+	ValueRandom
+)
+
+var valueKindNames []string = []string{
+	"in",
+	"time",
+	"random",
+}
+
+func (k ValueKind) String() string {
+	if k < 0 || int(k) >= len(valueKindNames) {
+		return "unknown"
+	}
+
+	return valueKindNames[k]
+}
+
+// ParseValueKind is the reverse of ValueKind.String
+func ParseValueKind(name string) (ValueKind, bool) {
+	for i, n := range valueKindNames {
+		if n == name {
+			return ValueKind(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// ReadValueFunc produces a value the usual way: reading the input, the
+// clock or the random number generator. eof is only set for input.
+type ReadValueFunc func() (value int32, eof bool, err error)
+
+// NondeterminismFunc is given every value a program can't predict before
+// the program sees it: numbers read by IN, the time and random numbers.
+// It returns the value to use, which is normally what read gives, and can
+// log it. A replay instead returns a logged value without calling read.
+type NondeterminismFunc func(c *Cpu, kind ValueKind, read ReadValueFunc) (int32, bool, error)
+
+// SetNondeterminism routes every unpredictable value through fn, or
+// straight to the program if fn is nil
+func (c *Cpu) SetNondeterminism(fn NondeterminismFunc) {
+	c.nondeterminism = fn
+}
+
+// nondeterministic produces a value through the hook, if there is one
+func (c *Cpu) nondeterministic(kind ValueKind, read ReadValueFunc) (int32, bool, error) {
+	if c.nondeterminism == nil {
+		return read()
+	}
+
+	return c.nondeterminism(c, kind, read)
+}
@@ -0,0 +1,107 @@
+package cpu
+
+import "sync/atomic"
+
+// Observer is told what a running program does, one event at a time.
+// Embed BaseObserver to implement only the callbacks that are needed.
+type Observer interface {
+	// BeforeInstruction is called just before the instruction at ip runs
+	BeforeInstruction(c *Cpu, ip int, opcode int32, operand int32)
+	MemoryRead(c *Cpu, addr int32, value int32)
+	MemoryWrite(c *Cpu, addr int32, old int32, new int32)
+	Push(c *Cpu, value int32)
+	Pop(c *Cpu, value int32)
+	// Branch is called when a jump is taken
+	Branch(c *Cpu, from int, to int)
+	IO(c *Cpu, event IOEvent)
+	// Halt is called once when Run returns, with the error it returns
+	Halt(c *Cpu, err error)
+}
+
+// IOEvent describes data passing between the program and the outside
+type IOEvent struct {
+	Opcode int32
+
+	// Descriptor is the file or socket used, 0 and 1 for console input
+	// and output, or the other cpu's address for MSEND and MRECV
+	Descriptor int32
+
+	// Block is the disk block read or written by READBLK and WRITEBLK
+	Block int32
+
+	// Data holds the bytes transferred. For IN and OUT it's the number as
+	// text.
+	Data []byte
+}
+
+// BaseObserver does nothing with every event
+type BaseObserver struct{}
+
+func (BaseObserver) BeforeInstruction(c *Cpu, ip int, opcode int32, operand int32) {}
+func (BaseObserver) MemoryRead(c *Cpu, addr int32, value int32)                    {}
+func (BaseObserver) MemoryWrite(c *Cpu, addr int32, old int32, new int32)          {}
+func (BaseObserver) Push(c *Cpu, value int32)                                      {}
+func (BaseObserver) Pop(c *Cpu, value int32)                                       {}
+func (BaseObserver) Branch(c *Cpu, from int, to int)                               {}
+func (BaseObserver) IO(c *Cpu, event IOEvent)                                      {}
+func (BaseObserver) Halt(c *Cpu, err error)                                        {}
+
+// AddObserver starts sending events to o. Observers are called in the
+// order they were added, on the goroutine running the cpu, and should
+// only be added or removed while the cpu isn't running or is paused.
+func (c *Cpu) AddObserver(o Observer) {
+	c.observers = append(c.observers, o)
+}
+
+func (c *Cpu) RemoveObserver(o Observer) {
+	for i, v := range c.observers {
+		if v == o {
+			c.observers = append(c.observers[:i:i], c.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+// load reads a heap word that's already been checked
+func (c *Cpu) load(addr int32) int32 {
+	v := c.peek(addr)
+	if len(c.observers) > 0 {
+		for _, o := range c.observers {
+			o.MemoryRead(c, addr, v)
+		}
+	}
+
+	return v
+}
+
+// store writes a heap word that's already been checked
+func (c *Cpu) store(addr int32, v int32) {
+	if c.history != nil {
+		c.recordWrite(c.Heap, addr, true)
+	}
+
+	var old int32
+	if c.sharedHeap {
+		old = atomic.SwapInt32(&c.Heap[addr], v)
+	} else {
+		old = c.Heap[addr]
+		c.Heap[addr] = v
+	}
+	if len(c.observers) > 0 {
+		for _, o := range c.observers {
+			o.MemoryWrite(c, addr, old, v)
+		}
+	}
+}
+
+func (c *Cpu) notifyIO(event IOEvent) {
+	for _, o := range c.observers {
+		o.IO(c, event)
+	}
+}
+
+func (c *Cpu) notifyBranch(from int, to int) {
+	for _, o := range c.observers {
+		o.Branch(c, from, to)
+	}
+}
@@ -0,0 +1,137 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// ErrIncompatibleReload is returned by Reload when the new build can't
+// take over from the running one
+var ErrIncompatibleReload = errors.New("can't reload")
+
+// Executable returns the program the cpu is running
+func (c *Cpu) Executable() *executable.ExecutableFile {
+	return c.file
+}
+
+// Reload swaps in a new build of the running program, keeping the heap,
+// stacks and threads. The cpu mustn't be running, though it can be
+// paused. Both builds need debug info: each instruction pointer is moved
+// to the same offset from the same code label in the new code, where it
+// must find the same instruction, and every data label must keep its
+// address. The new heap can be bigger, with the
+// extra words taken from its data section. Nothing is changed if the new
+// build isn't compatible.
+func (c *Cpu) Reload(file *executable.ExecutableFile) error {
+	if c.State() == StateRunning {
+		return ErrNotPaused
+	} else if c.sharedHeap {
+		return fmt.Errorf("%w: the heap is shared with other cores", ErrIncompatibleReload)
+	} else if c.file.Debug == nil || file.Debug == nil {
+		return fmt.Errorf("%w: both builds need debug info", ErrIncompatibleReload)
+	} else if int(file.Header.HeapSize) < len(c.Heap) {
+		return fmt.Errorf("%w: the heap shrank from %d to %d words", ErrIncompatibleReload, len(c.Heap), file.Header.HeapSize)
+	} else if int(file.Header.StackSize) != c.stackSize {
+		return fmt.Errorf("%w: the stack size changed", ErrIncompatibleReload)
+	} else if c.limits.MaxHeapSize > 0 && int(file.Header.HeapSize) > c.limits.MaxHeapSize {
+		return &LimitError{Kind: ErrHeapLimit, Limit: int64(c.limits.MaxHeapSize)}
+	}
+
+	for _, label := range c.file.Debug.Labels {
+		if !label.Data {
+			continue
+		}
+		if moved, ok := file.Debug.DataLabel(label.Name); !ok {
+			return fmt.Errorf("%w: data label '%s' is gone", ErrIncompatibleReload, label.Name)
+		} else if moved.Address != label.Address {
+			return fmt.Errorf("%w: data label '%s' moved from %d to %d", ErrIncompatibleReload, label.Name, label.Address, moved.Address)
+		}
+	}
+
+	ip, err := c.remapIP(file, c.InstructionPointer)
+	if err != nil {
+		return err
+	}
+	threadIPs := make([]int, len(c.threads))
+	for i, t := range c.threads {
+		if t.id == c.current || t.state == threadFinished {
+			continue
+		}
+		if threadIPs[i], err = c.remapIP(file, t.ip); err != nil {
+			return fmt.Errorf("thread %d: %w", t.id, err)
+		}
+	}
+
+	if int(file.Header.HeapSize) > len(c.Heap) {
+		heap := make([]int32, file.Header.HeapSize)
+		copy(heap, file.Data)
+		copy(heap, c.Heap)
+		c.Heap = heap
+		c.heapSize = len(heap)
+	}
+
+	c.file = file
+	c.Code = file.Code
+	c.codeSize = len(file.Code)
+	c.capabilities = file.Capabilities
+	c.InstructionPointer = ip
+	for i, t := range c.threads {
+		if t.id != c.current && t.state != threadFinished {
+			t.ip = threadIPs[i]
+		}
+	}
+	if c.history != nil {
+		c.SetHistory(len(c.history.steps))
+	}
+
+	return nil
+}
+
+// remapIP finds where ip, in the running code, is in file's code. It has
+// to be inside the block following the same code label, at the same
+// instruction; code before the first label counts as a block starting
+// at 0.
+func (c *Cpu) remapIP(file *executable.ExecutableFile, ip int) (int, error) {
+	label, ok := c.file.Debug.CodeLabelAt(ip)
+	if !ok {
+		label = executable.Label{}
+	}
+
+	start := int32(0)
+	if len(label.Name) > 0 {
+		moved, ok := file.Debug.CodeLabel(label.Name)
+		if !ok {
+			return 0, fmt.Errorf("%w: IP 0x%04X is after code label '%s', which is gone", ErrIncompatibleReload, ip, label.Name)
+		}
+		start = moved.Address
+	}
+
+	// the block ends at the next code label, or the end of the code
+	end := int32(len(file.Code))
+	for _, l := range file.Debug.Labels {
+		if !l.Data && l.Address > start && l.Address < end {
+			end = l.Address
+		}
+	}
+
+	result := start + int32(ip) - label.Address
+	if result >= end {
+		name := label.Name
+		if len(name) == 0 {
+			name = "the start"
+		}
+		return 0, fmt.Errorf("%w: IP 0x%04X is %d words after %s, past the end of it in the new code", ErrIncompatibleReload, ip, int32(ip)-label.Address, name)
+	}
+
+	// code added or removed earlier in the block shifts everything after
+	// it, which would leave the IP on some other instruction
+	if ip < len(c.Code) && c.Code[ip] != file.Code[result] {
+		return 0, fmt.Errorf("%w: IP 0x%04X is at %s, but %s in the new code", ErrIncompatibleReload, ip,
+			opcodes.GetPneumonic(uint32(c.Code[ip])), opcodes.GetPneumonic(uint32(file.Code[result])))
+	}
+
+	return int(result), nil
+}
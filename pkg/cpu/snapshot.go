@@ -0,0 +1,453 @@
+package cpu
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// SnapshotVersion is the version of the snapshot format written by
+// Snapshot.Write. Older versions are refused rather than guessed at.
+const SnapshotVersion = 1
+
+// snapshotMagic is "KBSN"
+const snapshotMagic = 0x4B42534E
+
+var (
+	ErrBadSnapshot      = errors.New("invalid snapshot")
+	ErrSnapshotMismatch = errors.New("snapshot doesn't match the program")
+	ErrOpenDescriptors  = errors.New("program has open files or sockets")
+
+	// ErrFinished is returned by Restore for a snapshot taken when the
+	// program halted at its last instruction, leaving nothing to carry on
+	// with
+	ErrFinished = errors.New("program halted at its last instruction")
+)
+
+// Snapshot is everything needed to carry on running a program later, or
+// on another machine: registers, memory, threads and how far the input
+// has been read. Open files and sockets can't be saved, so a cpu with any
+// open can't be snapshotted.
+type Snapshot struct {
+	// Program is the executable the cpu was created from, if it came from
+	// a file
+	Program string
+
+	IP           int
+	SP           int
+	Halted       bool
+	Instructions int64
+	GasUsed      int64
+
+	// InputLine is the number of input lines consumed, and EOF whether the
+	// input had ended
+	InputLine int
+	EOF       bool
+
+	// Stack holds the running thread's stack up to SP, and StackSize is
+	// its full size
+	Stack     []int32
+	StackSize int
+	Heap      []int32
+	Code      []int32
+
+	// Threads is empty unless the program has spawned any. The running
+	// thread's entry is only a placeholder, as its registers are above.
+	Threads []SnapshotThread
+	Current int32
+	Slice   int
+}
+
+// SnapshotThread is a thread's state in a snapshot
+type SnapshotThread struct {
+	IP        int
+	SP        int
+	Stack     []int32
+	StackSize int
+	Finished  bool
+	Joining   int32 // -1 unless the thread is waiting in JOIN
+}
+
+// Snapshot captures the cpu's state. The cpu mustn't be running, though it
+// can be paused.
+func (c *Cpu) Snapshot() (*Snapshot, error) {
+	if c.State() == StateRunning {
+		return nil, ErrNotPaused
+	}
+
+	return c.snapshot()
+}
+
+// SetCheckpoint makes Run call fn with a snapshot whenever the instruction
+// count reaches a multiple of n. Checkpoints that fall while the program
+// has files or sockets open are skipped. An error from fn stops the
+// program. n of 0 turns checkpoints off.
+func (c *Cpu) SetCheckpoint(n int64, fn func(*Snapshot) error) {
+	c.checkpointEvery = n
+	c.checkpointFunc = fn
+}
+
+// checkpoint is called by Run between instructions
+func (c *Cpu) checkpoint() error {
+	if c.instructions%c.checkpointEvery != 0 || c.instructions == c.lastCheckpoint || c.halted {
+		return nil
+	}
+	c.lastCheckpoint = c.instructions
+
+	s, err := c.snapshot()
+	if errors.Is(err, ErrOpenDescriptors) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return c.checkpointFunc(s)
+}
+
+func (c *Cpu) snapshot() (*Snapshot, error) {
+	if len(c.descriptors) > 0 {
+		return nil, ErrOpenDescriptors
+	} else if c.sharedHeap {
+		return nil, errors.New("can't snapshot a core sharing its heap")
+	}
+
+	result := &Snapshot{
+		Program:      c.file.Filename,
+		IP:           c.InstructionPointer,
+		SP:           c.StackPointer,
+		Halted:       c.halted,
+		Instructions: c.instructions,
+		GasUsed:      c.gasUsed,
+		InputLine:    c.console.line,
+		EOF:          c.console.eof,
+		Stack:        slices.Clone(c.Stack[:c.StackPointer]),
+		StackSize:    len(c.Stack),
+		Heap:         slices.Clone(c.Heap),
+		Code:         c.Code,
+		Current:      c.current,
+		Slice:        c.slice,
+	}
+
+	for _, t := range c.threads {
+		st := SnapshotThread{Joining: -1, Finished: t.state == threadFinished}
+		if t.state == threadJoining {
+			st.Joining = t.joining
+		}
+		if t.id != c.current && t.stack != nil {
+			st.IP, st.SP = t.ip, t.sp
+			st.Stack = slices.Clone(t.stack[:t.sp])
+			st.StackSize = len(t.stack)
+		}
+		result.Threads = append(result.Threads, st)
+	}
+
+	return result, nil
+}
+
+// Restore replaces the cpu's state with s. The cpu must have been created
+// from the same program and mustn't be running. Input lines the program
+// had already read are skipped from a non-interactive input, so set the
+// input first. A program saved at HALT carries on from the instruction
+// after it, so one that halted at its last instruction can't be restored.
+func (c *Cpu) Restore(s *Snapshot) error {
+	if state := c.State(); state == StateRunning || state == StatePaused {
+		return errors.New("can't restore a cpu that's running")
+	}
+
+	switch {
+	case !slices.Equal(s.Code, c.Code):
+		return fmt.Errorf("%w: the code is different", ErrSnapshotMismatch)
+	case len(s.Heap) != len(c.Heap):
+		return fmt.Errorf("%w: heap is %d words, not %d", ErrSnapshotMismatch, len(s.Heap), len(c.Heap))
+	case s.SP < 0 || s.StackSize < 0 || s.SP > s.StackSize:
+		return fmt.Errorf("%w: stack pointer %d in a stack of %d words", ErrBadSnapshot, s.SP, s.StackSize)
+	case s.StackSize > c.stackSize:
+		return fmt.Errorf("%w: stack is %d words, not %d", ErrSnapshotMismatch, s.StackSize, c.stackSize)
+	case len(s.Threads) == 0 && s.Current != 0:
+		return fmt.Errorf("%w: no thread %d", ErrBadSnapshot, s.Current)
+	case len(s.Threads) > 0 && (s.Current < 0 || int(s.Current) >= len(s.Threads)):
+		return fmt.Errorf("%w: no thread %d", ErrBadSnapshot, s.Current)
+	case s.Halted && (s.IP < 0 || s.IP+1 >= len(c.Code)):
+		return ErrFinished
+	}
+
+	threads := []*thread{}
+	for i, st := range s.Threads {
+		t := &thread{id: int32(i), ip: st.IP, sp: st.SP, joining: st.Joining}
+		switch {
+		case st.Finished:
+			t.state = threadFinished
+		case st.Joining >= 0:
+			t.state = threadJoining
+		}
+		if !st.Finished && t.id != s.Current {
+			if st.SP < 0 || st.StackSize < 0 || st.SP > st.StackSize || st.StackSize > c.stackSize {
+				return fmt.Errorf("%w: thread %d's stack is too big", ErrBadSnapshot, i)
+			}
+			t.stack = make([]int32, st.StackSize)
+			copy(t.stack, st.Stack)
+		}
+		threads = append(threads, t)
+	}
+
+	if len(c.Stack) != s.StackSize {
+		c.Stack = make([]int32, s.StackSize)
+	}
+	copy(c.Stack, s.Stack)
+	copy(c.Heap, s.Heap)
+	c.InstructionPointer = s.IP
+	c.StackPointer = s.SP
+	c.halted = s.Halted
+	c.instructions = s.Instructions
+	c.lastCheckpoint = s.Instructions
+	c.gasUsed = s.GasUsed
+	c.current = s.Current
+	c.slice = s.Slice
+	c.reschedule = false
+	c.threads = nil
+	if c.history != nil {
+		c.SetHistory(len(c.history.steps))
+	}
+	if len(threads) > 0 {
+		c.threads = threads
+	}
+
+	c.console.eof = s.EOF
+	if !c.console.interactive {
+		for c.console.line < s.InputLine {
+			if _, err := c.console.in.ReadString('\n'); err != nil {
+				break
+			}
+			c.console.line++
+		}
+	}
+	c.console.line = s.InputLine
+
+	return nil
+}
+
+// snapshotRegisters is the fixed part of a snapshot after the program name
+type snapshotRegisters struct {
+	IP           int32
+	SP           int32
+	StackSize    int32
+	Halted       bool
+	EOF          bool
+	InputLine    int32
+	Instructions int64
+	GasUsed      int64
+	Current      int32
+	Slice        int32
+	Threads      int32
+}
+
+type snapshotThread struct {
+	IP        int32
+	SP        int32
+	StackSize int32
+	Finished  bool
+	Joining   int32
+}
+
+// Write serializes the snapshot: a magic number and version, the state,
+// and a CRC-32 of everything before it so a damaged or partly written
+// file is caught by ReadSnapshot
+func (s *Snapshot) Write(w io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	write := func(v any) {
+		binary.Write(buf, executable.Endian, v)
+	}
+	writeWords := func(words []int32) {
+		write(int32(len(words)))
+		write(words)
+	}
+
+	write(uint32(snapshotMagic))
+	write(uint32(SnapshotVersion))
+	write(int32(len(s.Program)))
+	buf.WriteString(s.Program)
+	write(snapshotRegisters{
+		IP:           int32(s.IP),
+		SP:           int32(s.SP),
+		StackSize:    int32(s.StackSize),
+		Halted:       s.Halted,
+		EOF:          s.EOF,
+		InputLine:    int32(s.InputLine),
+		Instructions: s.Instructions,
+		GasUsed:      s.GasUsed,
+		Current:      s.Current,
+		Slice:        int32(s.Slice),
+		Threads:      int32(len(s.Threads)),
+	})
+	writeWords(s.Code)
+	writeWords(s.Heap)
+	writeWords(s.Stack)
+	for _, t := range s.Threads {
+		write(snapshotThread{
+			IP:        int32(t.IP),
+			SP:        int32(t.SP),
+			StackSize: int32(t.StackSize),
+			Finished:  t.Finished,
+			Joining:   t.Joining,
+		})
+		writeWords(t.Stack)
+	}
+	write(crc32.ChecksumIEEE(buf.Bytes()))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Save writes the snapshot to a file. It's written to a temporary file
+// first and renamed into place, so a crash part way through leaves any
+// earlier file with the same name intact.
+func (s *Snapshot) Save(filename string) error {
+	return writeFileAtomic(filename, s.Write)
+}
+
+// writeFileAtomic writes a file through a temporary one that's renamed
+// into place once it's complete
+func writeFileAtomic(filename string, write func(io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+// ReadSnapshot parses a snapshot written by Snapshot.Write
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 12 {
+		return nil, fmt.Errorf("%w: too short", ErrBadSnapshot)
+	} else if executable.Endian.Uint32(data) != snapshotMagic {
+		return nil, fmt.Errorf("%w: not a snapshot", ErrBadSnapshot)
+	} else if version := executable.Endian.Uint32(data[4:]); version != SnapshotVersion {
+		return nil, fmt.Errorf("%w: version %d isn't supported", ErrBadSnapshot, version)
+	}
+
+	body, sum := data[:len(data)-4], executable.Endian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: checksum doesn't match", ErrBadSnapshot)
+	}
+
+	br := bytes.NewReader(body[8:])
+	var readErr error
+	read := func(v any) {
+		if readErr == nil {
+			readErr = binary.Read(br, executable.Endian, v)
+		}
+	}
+	readWords := func() []int32 {
+		var n int32
+		read(&n)
+		if readErr != nil {
+			return nil
+		} else if n < 0 || int(n) > br.Len()/4 {
+			readErr = fmt.Errorf("%w: bad length %d", ErrBadSnapshot, n)
+			return nil
+		}
+		words := make([]int32, n)
+		read(words)
+		return words
+	}
+
+	var nameLen int32
+	read(&nameLen)
+	if readErr == nil && (nameLen < 0 || int(nameLen) > br.Len()) {
+		return nil, fmt.Errorf("%w: bad name length %d", ErrBadSnapshot, nameLen)
+	}
+	name := make([]byte, max(nameLen, 0))
+	read(name)
+
+	regs := snapshotRegisters{}
+	read(&regs)
+	result := &Snapshot{
+		Program:      string(name),
+		IP:           int(regs.IP),
+		SP:           int(regs.SP),
+		StackSize:    int(regs.StackSize),
+		Halted:       regs.Halted,
+		EOF:          regs.EOF,
+		InputLine:    int(regs.InputLine),
+		Instructions: regs.Instructions,
+		GasUsed:      regs.GasUsed,
+		Current:      regs.Current,
+		Slice:        int(regs.Slice),
+	}
+	result.Code = readWords()
+	result.Heap = readWords()
+	result.Stack = readWords()
+	for i := int32(0); i < regs.Threads && readErr == nil; i++ {
+		t := snapshotThread{}
+		read(&t)
+		result.Threads = append(result.Threads, SnapshotThread{
+			IP:        int(t.IP),
+			SP:        int(t.SP),
+			StackSize: int(t.StackSize),
+			Finished:  t.Finished,
+			Joining:   t.Joining,
+			Stack:     readWords(),
+		})
+	}
+
+	if readErr != nil {
+		if errors.Is(readErr, ErrBadSnapshot) {
+			return nil, readErr
+		}
+		return nil, fmt.Errorf("%w: %w", ErrBadSnapshot, readErr)
+	} else if br.Len() > 0 {
+		return nil, fmt.Errorf("%w: %d bytes left over", ErrBadSnapshot, br.Len())
+	} else if result.SP < 0 || result.SP > result.StackSize || len(result.Stack) != result.SP {
+		return nil, fmt.Errorf("%w: stack pointer %d is out of range", ErrBadSnapshot, result.SP)
+	}
+
+	return result, nil
+}
+
+// LoadSnapshot reads a snapshot file
+func LoadSnapshot(filename string) (*Snapshot, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result, err := ReadSnapshot(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return result, nil
+}
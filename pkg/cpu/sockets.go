@@ -0,0 +1,208 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// pollInterval is how long a blocking operation waits before checking
+// whether the cpu has been stopped or paused
+const pollInterval = 100 * time.Millisecond
+
+type networkPolicy struct {
+	loopbackOnly bool
+}
+
+// EnableNetwork gives the program access to TCP sockets. With loopbackOnly
+// set, only addresses on the local machine can be used.
+func (c *Cpu) EnableNetwork(loopbackOnly bool) {
+	c.network = &networkPolicy{loopbackOnly: loopbackOnly}
+}
+
+func (c *Cpu) socketOp(opcode int32, param int32) error {
+	if err := c.require(executable.CapNet); err != nil {
+		return err
+	}
+
+	if c.network == nil {
+		return fmt.Errorf("%w: networking not enabled", ErrNoDevice)
+	}
+
+	switch opcode {
+	case opcodes.LISTEN, opcodes.CONNECT:
+		address, err := c.readString(param)
+		if err != nil {
+			return err
+		}
+
+		if opcode == opcodes.LISTEN {
+			return c.push(c.listen(address))
+		}
+
+		result, err := c.connect(address)
+		if err != nil {
+			return err
+		}
+		return c.push(result)
+	case opcodes.ACCEPT:
+		sd, err := c.pop()
+		if err != nil {
+			return err
+		}
+
+		result, err := c.accept(sd)
+		if err != nil {
+			return err
+		}
+		return c.push(result)
+	}
+
+	return nil
+}
+
+func (c *Cpu) listen(address string) int32 {
+	addr, code := c.resolve(address)
+	if code < 0 {
+		return code
+	}
+
+	sd := c.nextDescriptor()
+	if sd < 0 {
+		return sd
+	}
+
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return errorCode(err)
+	}
+
+	c.descriptors[sd] = l
+	return sd
+}
+
+func (c *Cpu) accept(sd int32) (int32, error) {
+	l, ok := c.descriptors[sd].(*net.TCPListener)
+	if !ok {
+		return ErrCodeBadDescriptor, nil
+	}
+
+	fd := c.nextDescriptor()
+	if fd < 0 {
+		return fd, nil
+	}
+
+	var conn net.Conn
+	err := c.blocking(l, alwaysRestart, func() error {
+		var err error
+		conn, err = l.Accept()
+		return err
+	})
+	if isControl(err) {
+		return 0, err
+	} else if err != nil {
+		return errorCode(err), nil
+	}
+
+	c.descriptors[fd] = conn
+	return fd, nil
+}
+
+func (c *Cpu) connect(address string) (int32, error) {
+	addr, code := c.resolve(address)
+	if code < 0 {
+		return code, nil
+	}
+
+	fd := c.nextDescriptor()
+	if fd < 0 {
+		return fd, nil
+	}
+
+	for {
+		if err := c.waitCheck(true); err != nil {
+			return 0, err
+		}
+
+		conn, err := net.DialTimeout("tcp", addr.String(), pollInterval)
+		if isTimeout(err) {
+			continue
+		} else if err != nil {
+			return errorCode(err), nil
+		}
+
+		c.descriptors[fd] = conn
+		return fd, nil
+	}
+}
+
+// resolve parses a "host:port" address and applies the network policy.
+// In loopback only mode an empty host means the loopback interface.
+func (c *Cpu) resolve(address string) (*net.TCPAddr, int32) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, ErrCodeInvalid
+	}
+
+	if c.network.loopbackOnly {
+		if addr.IP == nil {
+			addr.IP = net.IPv4(127, 0, 0, 1)
+		} else if !addr.IP.IsLoopback() {
+			return nil, ErrCodePermission
+		}
+	}
+
+	return addr, 0
+}
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// blocking runs op, which may block on d, in short slices so that the cpu
+// can still be stopped or paused. op is retried after each timeout and
+// must pick up where it left off. canRestart says whether the instruction
+// can still be abandoned and run again after a pause. Anything that can't
+// time out is just run.
+func (c *Cpu) blocking(d interface{}, canRestart func() bool, op func() error) error {
+	dl, ok := d.(deadliner)
+	if _, isFile := d.(*os.File); !ok || isFile {
+		return op()
+	}
+	defer dl.SetDeadline(time.Time{})
+
+	for {
+		if err := c.waitCheck(canRestart()); err != nil {
+			return err
+		}
+
+		if err := dl.SetDeadline(time.Now().Add(pollInterval)); err != nil {
+			return fmt.Errorf("unable to set deadline: %w", err)
+		}
+
+		if err := op(); !isTimeout(err) {
+			return err
+		}
+	}
+}
+
+func alwaysRestart() bool {
+	return true
+}
+
+// isControl reports whether err came from a stop or pause request rather
+// than the operation itself
+func isControl(err error) bool {
+	var limitErr *LimitError
+	return err == errRestart || errors.Is(err, ErrInterrupted) || errors.As(err, &limitErr)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,59 @@
+package cpu
+
+import (
+	"fmt"
+)
+
+// MaxStringLength is the longest string the VM will read out of the heap
+const MaxStringLength = 4096
+
+// readString reads a NUL-terminated string stored one character per word
+// starting at addr
+func (c *Cpu) readString(addr int32) (string, error) {
+	result := []byte{}
+	for i := addr; ; i++ {
+		if err := c.checkAddress(i); err != nil {
+			return "", err
+		}
+
+		ch := c.load(i)
+		if ch == 0 {
+			break
+		}
+
+		result = append(result, byte(ch))
+		if len(result) > MaxStringLength {
+			return "", fmt.Errorf("%w: string at %d longer than %d characters", ErrInvalidOperand, addr, MaxStringLength)
+		}
+	}
+
+	return string(result), nil
+}
+
+// writeString stores s one character per word starting at addr, followed
+// by a NUL. At most size words are written, so a long string is truncated.
+func (c *Cpu) writeString(addr int32, size int32, s string) error {
+	if len(s) > int(size)-1 {
+		s = s[:size-1]
+	}
+
+	if err := c.checkRange(addr, int32(len(s)+1)); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(s); i++ {
+		c.store(addr+int32(i), int32(s[i]))
+	}
+	c.store(addr+int32(len(s)), 0)
+
+	return nil
+}
+
+// checkRange makes sure the count words starting at addr are all on the heap
+func (c *Cpu) checkRange(addr int32, count int32) error {
+	if addr < 0 || count < 0 || int(addr)+int(count) > c.heapSize {
+		return fmt.Errorf("%w: range %d-%d", ErrInvalidMemory, addr, int(addr)+int(count)-1)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// SyscallFunc is a host function called by the SYS instruction. It
+// exchanges values with the program through Pop and Push.
+type SyscallFunc func(c *Cpu) error
+
+type Syscall struct {
+	Number int32
+	Name   string
+	Func   SyscallFunc
+
+	// Capability the program needs to call this syscall
+	Capability executable.Capabilities
+}
+
+// Syscalls maps SYS operands onto host functions. The same table should
+// be given to the assembler, through Names, so that programs can use the
+// symbolic names. Registering isn't safe while a cpu using the table
+// is running.
+type Syscalls struct {
+	byNumber map[int32]*Syscall
+	byName   map[string]*Syscall
+	next     int32
+}
+
+func NewSyscalls() *Syscalls {
+	return &Syscalls{
+		byNumber: make(map[int32]*Syscall),
+		byName:   make(map[string]*Syscall),
+		next:     1,
+	}
+}
+
+// StandardSyscalls returns a table holding the syscalls every kabbit VM
+// provides:
+//
+//	1 time    pushes the current Unix time in seconds (needs CapTime)
+//	2 random  pops n and pushes a random number from 0 to n-1
+func StandardSyscalls() *Syscalls {
+	result := NewSyscalls()
+	result.register(1, "time", executable.CapTime, func(c *Cpu) error {
+		now, _, err := c.nondeterministic(ValueTime, func() (int32, bool, error) {
+			return int32(time.Now().Unix()), false, nil
+		})
+		if err != nil {
+			return err
+		}
+		return c.Push(now)
+	})
+	result.Register(2, "random", func(c *Cpu) error {
+		n, err := c.Pop()
+		if err != nil {
+			return err
+		} else if n < 1 {
+			return fmt.Errorf("%w: random range must be positive, got %d", ErrInvalidOperand, n)
+		}
+		v, _, err := c.nondeterministic(ValueRandom, func() (int32, bool, error) {
+			return rand.Int31n(n), false, nil
+		})
+		if err != nil {
+			return err
+		}
+		return c.Push(v)
+	})
+	return result
+}
+
+// Register adds fn under both number and name. Neither can already be in
+// use. Programs need CapSys to call it.
+func (s *Syscalls) Register(number int32, name string, fn SyscallFunc) error {
+	return s.register(number, name, executable.CapSys, fn)
+}
+
+func (s *Syscalls) register(number int32, name string, capability executable.Capabilities, fn SyscallFunc) error {
+	if _, ok := s.byNumber[number]; ok {
+		return errors.New(fmt.Sprintf("syscall %d already registered", number))
+	} else if _, ok := s.byName[name]; ok {
+		return errors.New(fmt.Sprintf("syscall '%s' already registered", name))
+	} else if len(name) == 0 {
+		return errors.New("syscall name required")
+	}
+
+	sc := &Syscall{Number: number, Name: name, Func: fn, Capability: capability}
+	s.byNumber[number] = sc
+	s.byName[name] = sc
+	if number >= s.next {
+		s.next = number + 1
+	}
+
+	return nil
+}
+
+// RegisterNamed adds fn under the next unused number, which it returns
+func (s *Syscalls) RegisterNamed(name string, fn SyscallFunc) (int32, error) {
+	number := s.next
+	if err := s.Register(number, name, fn); err != nil {
+		return 0, err
+	}
+
+	return number, nil
+}
+
+func (s *Syscalls) Lookup(number int32) (*Syscall, bool) {
+	sc, ok := s.byNumber[number]
+	return sc, ok
+}
+
+func (s *Syscalls) LookupName(name string) (*Syscall, bool) {
+	sc, ok := s.byName[name]
+	return sc, ok
+}
+
+// Names returns the name to number mapping the assembler needs
+func (s *Syscalls) Names() map[string]int32 {
+	result := make(map[string]int32, len(s.byName))
+	for name, sc := range s.byName {
+		result[name] = sc.Number
+	}
+
+	return result
+}
+
+// All returns the registered syscalls ordered by number
+func (s *Syscalls) All() []*Syscall {
+	result := make([]*Syscall, 0, len(s.byNumber))
+	for _, sc := range s.byNumber {
+		result = append(result, sc)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Number < result[j].Number })
+
+	return result
+}
+
+// SetSyscalls replaces the table used by SYS. A new cpu starts with
+// StandardSyscalls.
+func (c *Cpu) SetSyscalls(s *Syscalls) {
+	c.syscalls = s
+}
+
+// Syscalls returns the table used by SYS
+func (c *Cpu) Syscalls() *Syscalls {
+	return c.syscalls
+}
+
+// Push puts v on top of the stack, for use by syscalls
+func (c *Cpu) Push(v int32) error {
+	return c.push(v)
+}
+
+// Pop removes and returns the top of the stack, for use by syscalls
+func (c *Cpu) Pop() (int32, error) {
+	return c.pop()
+}
+
+func (c *Cpu) syscall(number int32) error {
+	var sc *Syscall
+	if c.syscalls != nil {
+		sc, _ = c.syscalls.Lookup(number)
+	}
+	if sc == nil {
+		return fmt.Errorf("%w %d", ErrUnknownSyscall, number)
+	}
+
+	if err := c.require(sc.Capability); err != nil {
+		return err
+	}
+
+	if err := sc.Func(c); err != nil {
+		return fmt.Errorf("syscall %s: %w", sc.Name, err)
+	}
+
+	return nil
+}
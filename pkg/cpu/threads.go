@@ -0,0 +1,184 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hculpan/kabbit/pkg/opcodes"
+)
+
+// DefaultQuantum is the number of instructions a thread runs before the
+// scheduler moves on to the next one
+const DefaultQuantum = 100
+
+// MaxThreads is the number of threads, including the main one, that can
+// be alive at once
+const MaxThreads = 64
+
+// ThreadStackSize is the stack given to each spawned thread, in words. It
+// is never more than the main thread's stack.
+const ThreadStackSize = 64 * 1024
+
+var ErrDeadlock = errors.New("deadlock")
+
+type threadState int
+
+const (
+	threadRunnable threadState = iota
+	threadJoining
+	threadFinished
+)
+
+// thread holds the registers of a thread while it isn't running. The
+// running thread's registers live in the Cpu itself.
+type thread struct {
+	id      int32
+	ip      int
+	sp      int
+	stack   []int32
+	state   threadState
+	joining int32
+}
+
+// SetQuantum sets how many instructions a thread runs before another gets
+// a turn. Zero turns preemption off, so threads only switch on YIELD, JOIN
+// and HALT.
+func (c *Cpu) SetQuantum(n int) {
+	c.quantum = n
+}
+
+// ThreadID returns the ID of the running thread. The main thread is 0.
+func (c *Cpu) ThreadID() int32 {
+	return c.current
+}
+
+// Threads returns the number of threads that haven't finished
+func (c *Cpu) Threads() int {
+	if c.threads == nil {
+		return 1
+	}
+
+	count := 0
+	for _, t := range c.threads {
+		if t.state != threadFinished {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *Cpu) threadOp(opcode int32, param int32) error {
+	switch opcode {
+	case opcodes.SPAWN:
+		if param < 0 || param >= int32(c.codeSize) {
+			return fmt.Errorf("%w %d", ErrInvalidJump, param)
+		}
+
+		id, err := c.spawn(int(param))
+		if err != nil {
+			return err
+		}
+		return c.push(id)
+	case opcodes.YIELD:
+		c.reschedule = c.threads != nil
+	case opcodes.JOIN:
+		id, err := c.pop()
+		if err != nil {
+			return err
+		}
+
+		if id == c.current || id < 0 || c.threads == nil || int(id) >= len(c.threads) {
+			return fmt.Errorf("%w: can't join thread %d", ErrInvalidOperand, id)
+		}
+
+		if c.threads[id].state != threadFinished {
+			t := c.threads[c.current]
+			t.state = threadJoining
+			t.joining = id
+			c.reschedule = true
+		}
+	case opcodes.THREADID:
+		return c.push(c.current)
+	}
+
+	return nil
+}
+
+func (c *Cpu) spawn(ip int) (int32, error) {
+	if c.threads == nil {
+		c.threads = []*thread{{id: 0}}
+	}
+
+	if c.Threads() >= MaxThreads {
+		return 0, fmt.Errorf("%w: too many threads", ErrInvalidOperand)
+	}
+
+	size := ThreadStackSize
+	if size > c.stackSize {
+		size = c.stackSize
+	}
+
+	t := &thread{id: int32(len(c.threads)), ip: ip, stack: make([]int32, size)}
+	c.threads = append(c.threads, t)
+	return t.id, nil
+}
+
+// exitThread ends the running thread, which mustn't be the main one, and
+// wakes anything joining it
+func (c *Cpu) exitThread() {
+	t := c.threads[c.current]
+	t.state = threadFinished
+	t.stack = nil
+	c.Stack = nil
+	c.StackPointer = 0
+
+	for _, other := range c.threads {
+		if other.state == threadJoining && other.joining == t.id {
+			other.state = threadRunnable
+		}
+	}
+	c.reschedule = true
+}
+
+// schedule switches to the next runnable thread in round robin order. The
+// running thread carries on if nothing else can run, and if it can't run
+// either the program is deadlocked.
+func (c *Cpu) schedule() error {
+	c.reschedule = false
+	c.slice = 0
+
+	count := int32(len(c.threads))
+	for i := int32(1); i <= count; i++ {
+		next := c.threads[(c.current+i)%count]
+		if next.state != threadRunnable {
+			continue
+		}
+
+		if next.id != c.current {
+			c.switchTo(next)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrDeadlock, c.blockedThreads())
+}
+
+func (c *Cpu) switchTo(next *thread) {
+	t := c.threads[c.current]
+	t.ip, t.sp, t.stack = c.InstructionPointer, c.StackPointer, c.Stack
+
+	c.InstructionPointer, c.StackPointer, c.Stack = next.ip, next.sp, next.stack
+	c.current = next.id
+}
+
+func (c *Cpu) blockedThreads() string {
+	blocked := []string{}
+	for _, t := range c.threads {
+		if t.state == threadJoining {
+			blocked = append(blocked, fmt.Sprintf("thread %d waiting for thread %d", t.id, t.joining))
+		}
+	}
+
+	return strings.Join(blocked, ", ")
+}
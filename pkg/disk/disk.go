@@ -0,0 +1,131 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// BlockSize is the number of 32-bit words in a single block
+const BlockSize = 128
+
+// BlockBytes is the size of a single block in the image file
+const BlockBytes = BlockSize * 4
+
+// Disk is a block device backed by an image file. The image is a flat
+// sequence of blocks, each holding BlockSize words stored in executable.Endian
+// byte order.
+type Disk struct {
+	Filename string
+
+	file   *os.File
+	blocks int
+}
+
+// Open attaches an existing image file. The file size must be a whole
+// number of blocks.
+func Open(filename string) (*Disk, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size()%BlockBytes != 0 {
+		file.Close()
+		return nil, fmt.Errorf("disk image '%s' is %d bytes, not a multiple of the %d byte block size", filename, info.Size(), BlockBytes)
+	}
+
+	return &Disk{
+		Filename: filename,
+		file:     file,
+		blocks:   int(info.Size() / BlockBytes),
+	}, nil
+}
+
+// Create makes a new, zero-filled image file with the given number of blocks.
+// An existing file is truncated.
+func Create(filename string, blocks int) (*Disk, error) {
+	if blocks < 1 {
+		return nil, errors.New("disk image must have at least one block")
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.Truncate(int64(blocks) * BlockBytes); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Disk{
+		Filename: filename,
+		file:     file,
+		blocks:   blocks,
+	}, nil
+}
+
+// Blocks returns the number of blocks in the image
+func (d *Disk) Blocks() int {
+	return d.blocks
+}
+
+// ReadBlock fills buf with the contents of block n. buf must hold
+// exactly BlockSize words.
+func (d *Disk) ReadBlock(n int, buf []int32) error {
+	if err := d.checkBlock(n, buf); err != nil {
+		return err
+	}
+
+	bytes := make([]byte, BlockBytes)
+	if _, err := d.file.ReadAt(bytes, int64(n)*BlockBytes); err != nil && err != io.EOF {
+		return err
+	}
+
+	for i := range buf {
+		buf[i] = int32(executable.Endian.Uint32(bytes[i*4:]))
+	}
+
+	return nil
+}
+
+// WriteBlock stores buf in block n. buf must hold exactly BlockSize words.
+func (d *Disk) WriteBlock(n int, buf []int32) error {
+	if err := d.checkBlock(n, buf); err != nil {
+		return err
+	}
+
+	bytes := make([]byte, BlockBytes)
+	for i, v := range buf {
+		executable.Endian.PutUint32(bytes[i*4:], uint32(v))
+	}
+
+	_, err := d.file.WriteAt(bytes, int64(n)*BlockBytes)
+	return err
+}
+
+func (d *Disk) Close() error {
+	return d.file.Close()
+}
+
+func (d *Disk) checkBlock(n int, buf []int32) error {
+	if n < 0 || n >= d.blocks {
+		return fmt.Errorf("invalid block %d, disk has %d blocks", n, d.blocks)
+	}
+
+	if len(buf) != BlockSize {
+		return fmt.Errorf("block buffer must be %d words, got %d", BlockSize, len(buf))
+	}
+
+	return nil
+}
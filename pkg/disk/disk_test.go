@@ -0,0 +1,62 @@
+package disk
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReadWriteBlock(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "disk.bin")
+	d, err := Create(filename, 4)
+	if err != nil {
+		t.Fatalf("unable to create disk: %v", err)
+	}
+
+	buf := make([]int32, BlockSize)
+	for i := range buf {
+		buf[i] = int32(i * -3)
+	}
+	if err := d.WriteBlock(2, buf); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+	d.Close()
+
+	d, err = Open(filename)
+	if err != nil {
+		t.Fatalf("unable to open disk: %v", err)
+	}
+	defer d.Close()
+
+	if d.Blocks() != 4 {
+		t.Fatalf("expected 4 blocks, got %d", d.Blocks())
+	}
+
+	result := make([]int32, BlockSize)
+	if err := d.ReadBlock(2, result); err != nil {
+		t.Fatalf("unable to read block: %v", err)
+	}
+	for i := range result {
+		if result[i] != buf[i] {
+			t.Fatalf("word %d wrong. expected=%d, got=%d", i, buf[i], result[i])
+		}
+	}
+}
+
+func TestInvalidBlock(t *testing.T) {
+	d, err := Create(filepath.Join(t.TempDir(), "disk.bin"), 1)
+	if err != nil {
+		t.Fatalf("unable to create disk: %v", err)
+	}
+	defer d.Close()
+
+	buf := make([]int32, BlockSize)
+	if err := d.ReadBlock(1, buf); err == nil {
+		t.Fatalf("expected error reading past end of disk")
+	}
+	if err := d.WriteBlock(-1, buf); err == nil {
+		t.Fatalf("expected error writing negative block")
+	}
+	if err := d.ReadBlock(0, buf[1:]); err == nil {
+		t.Fatalf("expected error with short buffer")
+	}
+}
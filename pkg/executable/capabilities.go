@@ -0,0 +1,78 @@
+package executable
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Capabilities is the set of VM facilities a program may use
+type Capabilities uint32
+
+const (
+	CapConsole Capabilities = 1 << iota
+	CapFS
+	CapNet
+	CapTime
+	CapSys
+	CapDisk
+	CapMsg
+)
+
+// CapAll grants every capability
+const CapAll = CapConsole | CapFS | CapNet | CapTime | CapSys | CapDisk | CapMsg
+
+var capabilityNames []string = []string{
+	"console",
+	"fs",
+	"net",
+	"time",
+	"sys",
+	"disk",
+	"msg",
+}
+
+// ParseCapabilities converts capability names into a set
+func ParseCapabilities(names []string) (Capabilities, error) {
+	var result Capabilities = 0
+	for _, name := range names {
+		found := false
+		for i, v := range capabilityNames {
+			if strings.EqualFold(name, v) {
+				result |= 1 << i
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return 0, errors.New(fmt.Sprintf("unknown capability '%s'", name))
+		}
+	}
+
+	return result, nil
+}
+
+// Has reports whether every capability in other is also in c
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+func (c Capabilities) Names() []string {
+	result := []string{}
+	for i, v := range capabilityNames {
+		if c&(1<<i) != 0 {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+func (c Capabilities) String() string {
+	if c == 0 {
+		return "none"
+	}
+
+	return strings.Join(c.Names(), ", ")
+}
@@ -0,0 +1,178 @@
+package executable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// DebugInfo maps a program's code and data back to the source it was
+// assembled from
+type DebugInfo struct {
+	Source string
+
+	// Lines has one entry per instruction, in code order
+	Lines []LineInfo
+
+	// Labels are sorted by address, with code and data labels mixed
+	Labels []Label
+}
+
+type LineInfo struct {
+	Address int32
+	Line    int32
+	Text    string
+}
+
+type Label struct {
+	Name    string
+	Address int32
+	Data    bool
+}
+
+// LineAt returns the source line of the instruction at ip
+func (d *DebugInfo) LineAt(ip int) (LineInfo, bool) {
+	i := sort.Search(len(d.Lines), func(i int) bool { return int(d.Lines[i].Address) >= ip })
+	if i < len(d.Lines) && int(d.Lines[i].Address) == ip {
+		return d.Lines[i], true
+	}
+
+	return LineInfo{}, false
+}
+
+// CodeLabelAt returns the closest code label at or before ip
+func (d *DebugInfo) CodeLabelAt(ip int) (Label, bool) {
+	return d.labelAt(int32(ip), false)
+}
+
+// DataLabelAt returns the closest data label at or before addr
+func (d *DebugInfo) DataLabelAt(addr int32) (Label, bool) {
+	return d.labelAt(addr, true)
+}
+
+// CodeLabel finds a code label by name
+func (d *DebugInfo) CodeLabel(name string) (Label, bool) {
+	return d.label(name, false)
+}
+
+// DataLabel finds a data label by name
+func (d *DebugInfo) DataLabel(name string) (Label, bool) {
+	return d.label(name, true)
+}
+
+func (d *DebugInfo) label(name string, data bool) (Label, bool) {
+	for _, label := range d.Labels {
+		if label.Data == data && label.Name == name {
+			return label, true
+		}
+	}
+
+	return Label{}, false
+}
+
+func (d *DebugInfo) labelAt(addr int32, data bool) (Label, bool) {
+	for i := len(d.Labels) - 1; i >= 0; i-- {
+		if d.Labels[i].Data == data && d.Labels[i].Address <= addr {
+			return d.Labels[i], true
+		}
+	}
+
+	return Label{}, false
+}
+
+// SortLabels puts the labels in address order
+func (d *DebugInfo) SortLabels() {
+	sort.SliceStable(d.Labels, func(i, j int) bool { return d.Labels[i].Address < d.Labels[j].Address })
+}
+
+func (d *DebugInfo) encode() []byte {
+	buf := new(bytes.Buffer)
+	writeString(buf, d.Source)
+
+	binary.Write(buf, Endian, uint32(len(d.Lines)))
+	for _, l := range d.Lines {
+		binary.Write(buf, Endian, l.Address)
+		binary.Write(buf, Endian, l.Line)
+		writeString(buf, l.Text)
+	}
+
+	binary.Write(buf, Endian, uint32(len(d.Labels)))
+	for _, l := range d.Labels {
+		writeString(buf, l.Name)
+		binary.Write(buf, Endian, l.Address)
+		var data uint8 = 0
+		if l.Data {
+			data = 1
+		}
+		binary.Write(buf, Endian, data)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeDebugInfo(payload []byte) (*DebugInfo, error) {
+	r := bytes.NewReader(payload)
+	result := &DebugInfo{}
+	var err error
+
+	if result.Source, err = readString(r); err != nil {
+		return nil, err
+	}
+
+	var count uint32
+	if err := binary.Read(r, Endian, &count); err != nil || int(count) > r.Len() {
+		return nil, errors.New("invalid debug section")
+	}
+	result.Lines = make([]LineInfo, count)
+	for i := range result.Lines {
+		l := &result.Lines[i]
+		if err := binary.Read(r, Endian, &l.Address); err != nil {
+			return nil, errors.New("invalid debug section")
+		}
+		if err := binary.Read(r, Endian, &l.Line); err != nil {
+			return nil, errors.New("invalid debug section")
+		}
+		if l.Text, err = readString(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := binary.Read(r, Endian, &count); err != nil || int(count) > r.Len() {
+		return nil, errors.New("invalid debug section")
+	}
+	result.Labels = make([]Label, count)
+	for i := range result.Labels {
+		l := &result.Labels[i]
+		if l.Name, err = readString(r); err != nil {
+			return nil, err
+		}
+		var data uint8
+		if err := binary.Read(r, Endian, &l.Address); err != nil {
+			return nil, errors.New("invalid debug section")
+		}
+		if err := binary.Read(r, Endian, &data); err != nil {
+			return nil, errors.New("invalid debug section")
+		}
+		l.Data = data != 0
+	}
+
+	return result, nil
+}
+
+func writeString(w io.Writer, s string) {
+	binary.Write(w, Endian, uint32(len(s)))
+	w.Write([]byte(s))
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, Endian, &length); err != nil || int(length) > r.Len() {
+		return "", errors.New("invalid debug section")
+	}
+
+	result := make([]byte, length)
+	r.Read(result)
+	return string(result), nil
+}
@@ -1,9 +1,12 @@
 package executable
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -14,6 +17,13 @@ type ExecutableFile struct {
 	Header   FileHeader
 	Code     []int32
 	Data     []int32
+
+	// Capabilities the program needs. Files written before the manifest
+	// existed are treated as needing only the console.
+	Capabilities Capabilities
+
+	// Debug is nil unless the assembler kept debug information
+	Debug *DebugInfo
 }
 
 func NewDefaultExecutableFile(filename string) *ExecutableFile {
@@ -24,17 +34,19 @@ func NewDefaultExecutableFile(filename string) *ExecutableFile {
 			StackSize: 1024 * 1024,
 			HeapSize:  0,
 		},
-		Code: []int32{},
-		Data: []int32{},
+		Code:         []int32{},
+		Data:         []int32{},
+		Capabilities: CapConsole,
 	}
 }
 
 func NewExecutableFile(filename string, header *FileHeader, code, data []int32) *ExecutableFile {
 	return &ExecutableFile{
-		Filename: filename,
-		Header:   *header,
-		Code:     code,
-		Data:     data,
+		Filename:     filename,
+		Header:       *header,
+		Code:         code,
+		Data:         data,
+		Capabilities: CapConsole,
 	}
 }
 
@@ -45,25 +57,30 @@ func (e *ExecutableFile) SaveFile() error {
 	}
 	defer f.Close()
 
+	return e.Write(f)
+}
+
+// Write serializes the executable in the same format as SaveFile
+func (e *ExecutableFile) Write(w io.Writer) error {
 	e.Header.CodeSize = uint32(len(e.Code))
 	e.Header.HeapSize = uint32(len(e.Data))
 
-	err = binary.Write(f, Endian, e.Header)
+	err := binary.Write(w, Endian, e.Header)
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(f, Endian, e.Code)
+	err = binary.Write(w, Endian, e.Code)
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(f, Endian, e.Data)
+	err = binary.Write(w, Endian, e.Data)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return e.writeSections(w)
 }
 
 func NewExecutableFromFile(filename string) (*ExecutableFile, error) {
@@ -73,9 +90,20 @@ func NewExecutableFromFile(filename string) (*ExecutableFile, error) {
 	}
 	defer file.Close()
 
+	return ReadExecutable(bufio.NewReader(file), filename)
+}
+
+// NewExecutableFromBytes parses an executable held in memory
+func NewExecutableFromBytes(data []byte, filename string) (*ExecutableFile, error) {
+	return ReadExecutable(bytes.NewReader(data), filename)
+}
+
+// ReadExecutable parses an executable from r. filename is only recorded
+// for messages.
+func ReadExecutable(r io.Reader, filename string) (*ExecutableFile, error) {
 	// Read the first 3 uint32 values (CodeSize, StackSize, HeapSize)
 	header := FileHeader{}
-	if err := binary.Read(file, Endian, &header); err != nil {
+	if err := binary.Read(r, Endian, &header); err != nil {
 		return nil, err
 	}
 
@@ -84,7 +112,7 @@ func NewExecutableFromFile(filename string) (*ExecutableFile, error) {
 	var data []int32 = []int32{}
 	for i := 0; i < int(header.CodeSize); i++ {
 		var value int32
-		err := binary.Read(file, Endian, &value)
+		err := binary.Read(r, Endian, &value)
 		if err != nil {
 			break // Reached the end of the file
 		}
@@ -93,17 +121,24 @@ func NewExecutableFromFile(filename string) (*ExecutableFile, error) {
 
 	for i := 0; i < int(header.HeapSize); i++ {
 		var value int32
-		err := binary.Read(file, Endian, &value)
+		err := binary.Read(r, Endian, &value)
 		if err != nil {
 			break // Reached the end of the file
 		}
 		data = append(data, value)
 	}
 
-	return &ExecutableFile{
-		Filename: filename,
-		Header:   header,
-		Code:     code,
-		Data:     data,
-	}, nil
+	result := &ExecutableFile{
+		Filename:     filename,
+		Header:       header,
+		Code:         code,
+		Data:         data,
+		Capabilities: CapConsole,
+	}
+
+	if err := result.readSections(r); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return result, nil
 }
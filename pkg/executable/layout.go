@@ -0,0 +1,31 @@
+package executable
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// LayoutFingerprint identifies where a program keeps its data. Two builds
+// of a program share a fingerprint when their heaps are the same size and
+// every data label has the same address, so heap contents saved by one
+// make sense to the other. Without debug info there are no labels to go
+// on, and the data section's initial values are used instead.
+func (e *ExecutableFile) LayoutFingerprint() [sha256.Size]byte {
+	h := sha256.New()
+	binary.Write(h, Endian, e.Header.HeapSize)
+
+	if e.Debug == nil {
+		h.Write([]byte{0})
+		binary.Write(h, Endian, e.Data)
+		return [sha256.Size]byte(h.Sum(nil))
+	}
+
+	h.Write([]byte{1})
+	for _, label := range e.Debug.Labels {
+		if label.Data {
+			writeString(h, label.Name)
+			binary.Write(h, Endian, label.Address)
+		}
+	}
+	return [sha256.Size]byte(h.Sum(nil))
+}
@@ -0,0 +1,79 @@
+package executable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Optional sections follow the data in an executable. Each one starts with
+// a tag and the length of its payload in bytes. Readers skip tags they
+// don't recognize, and readers that predate sections stop after the data.
+const (
+	SectionCapabilities uint32 = 0x43415053 // "CAPS"
+	SectionDebug        uint32 = 0x44425547 // "DBUG"
+)
+
+type sectionHeader struct {
+	Tag    uint32
+	Length uint32
+}
+
+func writeSection(w io.Writer, tag uint32, payload []byte) error {
+	if err := binary.Write(w, Endian, sectionHeader{Tag: tag, Length: uint32(len(payload))}); err != nil {
+		return err
+	}
+
+	_, err := w.Write(payload)
+	return err
+}
+
+func (e *ExecutableFile) writeSections(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, Endian, uint32(e.Capabilities))
+	if err := writeSection(w, SectionCapabilities, buf.Bytes()); err != nil {
+		return err
+	}
+
+	if e.Debug != nil {
+		if err := writeSection(w, SectionDebug, e.Debug.encode()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *ExecutableFile) readSections(r io.Reader) error {
+	for {
+		header := sectionHeader{}
+		if err := binary.Read(r, Endian, &header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.New("truncated section header")
+		}
+
+		// the length can't be trusted, so only allocate as much as the
+		// file actually holds
+		payload, err := io.ReadAll(io.LimitReader(r, int64(header.Length)))
+		if err != nil || len(payload) < int(header.Length) {
+			return errors.New(fmt.Sprintf("truncated section %08X", header.Tag))
+		}
+
+		switch header.Tag {
+		case SectionCapabilities:
+			if len(payload) < 4 {
+				return errors.New("invalid capabilities section")
+			}
+			e.Capabilities = Capabilities(Endian.Uint32(payload))
+		case SectionDebug:
+			debug, err := decodeDebugInfo(payload)
+			if err != nil {
+				return err
+			}
+			e.Debug = debug
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package machine runs several cores on one shared heap. Each core is a
+// cpu.Cpu running the same program from the start; they tell themselves
+// apart with COREID.
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+	"github.com/hculpan/kabbit/pkg/executable"
+)
+
+// MaxSlice is the most instructions a core runs in a row when cores are
+// interleaved from a seed
+const MaxSlice = 8
+
+// ErrParallelRaces is returned by Run when race detection was asked for
+// along with parallel cores
+var ErrParallelRaces = errors.New("race detection needs seeded interleaving")
+
+type Machine struct {
+	Cores []*cpu.Cpu
+	Heap  []int32
+
+	parallel bool
+	seed     int64
+	races    *raceDetector
+	failed   *cpu.Cpu
+}
+
+// New creates a machine with the given number of cores running file. The
+// cores can be configured individually before Run.
+func New(file *executable.ExecutableFile, cores int) *Machine {
+	heap := make([]int32, file.Header.HeapSize)
+	copy(heap, file.Data)
+
+	result := &Machine{Heap: heap, seed: 1}
+	for i := 0; i < cores; i++ {
+		result.Cores = append(result.Cores, cpu.NewCore(file, int32(i), heap))
+	}
+
+	return result
+}
+
+// SetSeed chooses the interleaving. The same seed always runs the cores
+// in the same order, as long as their input is the same.
+func (m *Machine) SetSeed(seed int64) {
+	m.seed = seed
+}
+
+// SetParallel runs each core on its own goroutine instead, so the order
+// is up to the Go scheduler and the hardware
+func (m *Machine) SetParallel(parallel bool) {
+	m.parallel = parallel
+}
+
+// DetectRaces watches for heap accesses from different cores that aren't
+// ordered by an atomic instruction or FENCE. It needs seeded interleaving.
+func (m *Machine) DetectRaces() {
+	if m.races != nil {
+		return
+	}
+
+	m.races = newRaceDetector(len(m.Cores))
+	for _, c := range m.Cores {
+		c.AddObserver(m.races)
+	}
+}
+
+// Races returns the conflicts found by DetectRaces
+func (m *Machine) Races() []Race {
+	if m.races == nil {
+		return nil
+	}
+	return m.races.races
+}
+
+// Failed returns the core whose error ended the last Run, or nil
+func (m *Machine) Failed() *cpu.Cpu {
+	return m.failed
+}
+
+// Run runs every core until they have all halted. If one fails the rest
+// are stopped, and the error names the core that failed.
+func (m *Machine) Run(ctx context.Context) error {
+	m.failed = nil
+	if m.parallel {
+		if m.races != nil {
+			return ErrParallelRaces
+		}
+		return m.runParallel(ctx)
+	}
+
+	return m.runSeeded(ctx)
+}
+
+// runSeeded interleaves the cores on this goroutine. Each core is driven
+// with Start and RunSteps, so limits, observers and checkpoints apply just
+// as they do when it runs on its own.
+func (m *Machine) runSeeded(ctx context.Context) error {
+	running := []*cpu.Cpu{}
+	for _, c := range m.Cores {
+		if err := c.Start(); err != nil {
+			m.failed = c
+			stopCores(running)
+			return fmt.Errorf("core %d: %w", c.CoreID(), err)
+		}
+		running = append(running, c)
+	}
+
+	random := rand.New(rand.NewSource(m.seed))
+	for steps := 0; len(running) > 0; steps++ {
+		if steps%1024 == 0 && ctx.Err() != nil {
+			stopCores(running)
+			return fmt.Errorf("%w: %w", cpu.ErrInterrupted, ctx.Err())
+		}
+
+		i := random.Intn(len(running))
+		c := running[i]
+		if err := c.RunSteps(random.Intn(MaxSlice) + 1); err != nil {
+			m.failed = c
+			stopCores(append(running[:i:i], running[i+1:]...))
+			return fmt.Errorf("core %d: %w", c.CoreID(), err)
+		}
+
+		if c.IsHalted() {
+			running = append(running[:i], running[i+1:]...)
+		}
+	}
+
+	return nil
+}
+
+// stopCores ends the runs of cores that were started but haven't finished
+func stopCores(cores []*cpu.Cpu) {
+	for _, c := range cores {
+		c.Stop()
+		c.RunSteps(1)
+	}
+}
+
+func (m *Machine) runParallel(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var failed error
+	wg := sync.WaitGroup{}
+	for _, c := range m.Cores {
+		wg.Add(1)
+		go func(c *cpu.Cpu) {
+			defer wg.Done()
+
+			if err := c.RunContext(ctx); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				if failed == nil {
+					m.failed = c
+					failed = fmt.Errorf("core %d: %w", c.CoreID(), err)
+					cancel()
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return failed
+}
@@ -0,0 +1,159 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hculpan/kabbit/internal/vmtest"
+	"github.com/hculpan/kabbit/pkg/cpu"
+)
+
+const unsafeCounter = `
+count:  wd 0
+        push 100
+loop:
+        ld count
+        inc
+        st count
+        dec
+        dup
+        jif loop
+        halt
+`
+
+const atomicCounter = `
+count:  wd 0
+        push 100
+loop:
+        push 1
+        fetchadd count
+        pop
+        dec
+        dup
+        jif loop
+        halt
+`
+
+// spinlock guards a plain increment with a lock taken and released by CAS
+const spinlock = `
+count:  wd 0
+lock:   wd 0
+        push 100
+loop:
+        push 0
+        push 1
+        cas lock
+        jif locked
+        jmp loop
+locked:
+        ld count
+        inc
+        st count
+        push 1
+        push 0
+        cas lock
+        pop
+        dec
+        dup
+        jif loop
+        halt
+`
+
+func TestSeededRaces(t *testing.T) {
+	file := vmtest.Assemble(t, unsafeCounter, nil)
+
+	results := []int32{}
+	for i := 0; i < 2; i++ {
+		m := New(file, 4)
+		m.SetSeed(42)
+		m.DetectRaces()
+		if err := m.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(m.Races()) == 0 {
+			t.Fatal("expected races on count")
+		}
+		results = append(results, m.Heap[1])
+	}
+
+	if results[0] != results[1] {
+		t.Fatalf("expected the same seed to give the same result, got %d and %d", results[0], results[1])
+	}
+	if results[0] >= 400 {
+		t.Fatalf("expected lost updates, got %d", results[0])
+	}
+}
+
+func TestAtomics(t *testing.T) {
+	file := vmtest.Assemble(t, atomicCounter, nil)
+
+	m := New(file, 4)
+	m.DetectRaces()
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m.Heap[1] != 400 {
+		t.Fatalf("expected 400, got %d", m.Heap[1])
+	}
+	if races := m.Races(); len(races) != 0 {
+		t.Fatalf("expected no races, got %v", races)
+	}
+
+	m = New(file, 4)
+	m.SetParallel(true)
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m.Heap[1] != 400 {
+		t.Fatalf("expected 400 with parallel cores, got %d", m.Heap[1])
+	}
+}
+
+func TestSpinlock(t *testing.T) {
+	m := New(vmtest.Assemble(t, spinlock, nil), 3)
+	m.SetSeed(7)
+	m.DetectRaces()
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Heap[1] != 300 {
+		t.Fatalf("expected 300, got %d", m.Heap[1])
+	}
+	if races := m.Races(); len(races) != 0 {
+		t.Fatalf("expected no races, got %v", races)
+	}
+}
+
+func TestSeededLimits(t *testing.T) {
+	m := New(vmtest.Assemble(t, `
+forever:
+        jmp forever
+`, nil), 2)
+	for _, c := range m.Cores {
+		c.SetLimits(cpu.Limits{MaxDuration: 20 * time.Millisecond})
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- m.Run(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, cpu.ErrTimeLimit) {
+			t.Fatalf("expected time limit, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("time limit didn't stop the machine")
+	}
+
+	for _, c := range m.Cores {
+		if state := c.State(); state == cpu.StateRunning {
+			t.Fatalf("expected core %d to have finished, still %s", c.CoreID(), state)
+		}
+	}
+}
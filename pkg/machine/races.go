@@ -0,0 +1,165 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+)
+
+// Access is one side of a race
+type Access struct {
+	Core  int32
+	IP    int
+	Write bool
+}
+
+func (a Access) String() string {
+	kind := "read"
+	if a.Write {
+		kind = "write"
+	}
+	return fmt.Sprintf("%s by core %d at IP 0x%04X", kind, a.Core, a.IP)
+}
+
+// Race is a pair of accesses to the same heap word, from different cores,
+// with at least one write and nothing ordering them
+type Race struct {
+	Addr     int32
+	Previous Access
+	Current  Access
+}
+
+func (r Race) String() string {
+	return fmt.Sprintf("heap %d: %s conflicts with earlier %s", r.Addr, r.Current, r.Previous)
+}
+
+// vectorClock holds what each core knows of every core's progress
+type vectorClock []int
+
+func (v vectorClock) join(other vectorClock) {
+	for i := range v {
+		if other[i] > v[i] {
+			v[i] = other[i]
+		}
+	}
+}
+
+// epoch is an access stamped with its core's clock at the time
+type epoch struct {
+	access Access
+	clock  int
+}
+
+type cell struct {
+	write *epoch
+	reads map[int32]epoch
+}
+
+// raceDetector is a happens-before checker. Atomic instructions synchronize
+// through a clock per address, FENCE through one shared clock, and any
+// pair of accesses not ordered by those is reported once for each pair
+// of instructions.
+type raceDetector struct {
+	cpu.BaseObserver
+
+	clocks []vectorClock
+	sync   map[int32]vectorClock
+	fence  vectorClock
+	cells  map[int32]*cell
+	seen   map[[3]int]bool
+	races  []Race
+}
+
+func newRaceDetector(cores int) *raceDetector {
+	result := &raceDetector{
+		sync:  make(map[int32]vectorClock),
+		fence: make(vectorClock, cores),
+		cells: make(map[int32]*cell),
+		seen:  make(map[[3]int]bool),
+	}
+
+	for i := 0; i < cores; i++ {
+		clock := make(vectorClock, cores)
+		clock[i] = 1
+		result.clocks = append(result.clocks, clock)
+	}
+
+	return result
+}
+
+func (r *raceDetector) MemoryRead(c *cpu.Cpu, addr int32, value int32) {
+	core := c.CoreID()
+	e := epoch{access: Access{Core: core, IP: c.InstructionPointer}, clock: r.clocks[core][core]}
+	cell := r.cell(addr)
+
+	if cell.write != nil {
+		r.check(addr, *cell.write, e)
+	}
+	cell.reads[core] = e
+}
+
+func (r *raceDetector) MemoryWrite(c *cpu.Cpu, addr int32, old int32, new int32) {
+	core := c.CoreID()
+	e := epoch{access: Access{Core: core, IP: c.InstructionPointer, Write: true}, clock: r.clocks[core][core]}
+	cell := r.cell(addr)
+
+	if cell.write != nil {
+		r.check(addr, *cell.write, e)
+	}
+	for _, read := range cell.reads {
+		r.check(addr, read, e)
+	}
+
+	cell.write = &e
+	cell.reads = make(map[int32]epoch)
+}
+
+func (r *raceDetector) Atomic(c *cpu.Cpu, addr int32, old int32, new int32) {
+	clock, ok := r.sync[addr]
+	if !ok {
+		clock = make(vectorClock, len(r.clocks))
+		r.sync[addr] = clock
+	}
+	r.synchronize(c.CoreID(), clock)
+}
+
+func (r *raceDetector) Fence(c *cpu.Cpu) {
+	r.synchronize(c.CoreID(), r.fence)
+}
+
+// synchronize acquires and releases through shared, then moves the core
+// on so its later accesses aren't covered by what it just released
+func (r *raceDetector) synchronize(core int32, shared vectorClock) {
+	r.clocks[core].join(shared)
+	shared.join(r.clocks[core])
+	r.clocks[core][core]++
+}
+
+// check reports a race unless previous happened before current, or they
+// were made by the same core, or neither is a write
+func (r *raceDetector) check(addr int32, previous epoch, current epoch) {
+	if previous.access.Core == current.access.Core || !(previous.access.Write || current.access.Write) {
+		return
+	}
+
+	if previous.clock <= r.clocks[current.access.Core][previous.access.Core] {
+		return
+	}
+
+	key := [3]int{int(addr), previous.access.IP, current.access.IP}
+	if r.seen[key] {
+		return
+	}
+	r.seen[key] = true
+
+	r.races = append(r.races, Race{Addr: addr, Previous: previous.access, Current: current.access})
+}
+
+func (r *raceDetector) cell(addr int32) *cell {
+	result, ok := r.cells[addr]
+	if !ok {
+		result = &cell{reads: make(map[int32]epoch)}
+		r.cells[addr] = result
+	}
+	return result
+}
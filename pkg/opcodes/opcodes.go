@@ -3,6 +3,7 @@ package opcodes
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
 type OperandType int
@@ -10,40 +11,81 @@ type OperandType int
 const (
 	NONE OperandType = iota
 	INT32
+	STRING
 )
 
 const (
-	PUSH  = 1
-	POP   = 2
-	ADD   = 3
-	SUB   = 4
-	MUL   = 5
-	DIV   = 6
-	DUP   = 7
-	DEC   = 8
-	INC   = 9
-	JMP   = 10
-	JIF   = 11
-	OUT   = 20
-	IN    = 21
-	ST    = 30
-	LD    = 31
-	STI   = 32
-	LDI   = 33
-	AND   = 40
-	OR    = 41
-	XOR   = 42
-	ISEQ  = 50
-	ISGT  = 51
-	ISGTE = 52
-	ISLT  = 53
-	ISLTE = 54
-	MINC  = 60
-	MDEC  = 61
-	INCI  = 62
-	DECI  = 63
-	HALT  = 0xFFFF
-	WD    = 0
+	PUSH     = 1
+	POP      = 2
+	ADD      = 3
+	SUB      = 4
+	MUL      = 5
+	DIV      = 6
+	DUP      = 7
+	DEC      = 8
+	INC      = 9
+	JMP      = 10
+	JIF      = 11
+	OUT      = 20
+	IN       = 21
+	OUTS     = 22
+	PRINTF   = 23
+	EOF      = 24
+	ARGC     = 25
+	ARGV     = 26
+	ENVC     = 27
+	ENVV     = 28
+	ST       = 30
+	LD       = 31
+	STI      = 32
+	LDI      = 33
+	AND      = 40
+	OR       = 41
+	XOR      = 42
+	ISEQ     = 50
+	ISGT     = 51
+	ISGTE    = 52
+	ISLT     = 53
+	ISLTE    = 54
+	MINC     = 60
+	MDEC     = 61
+	INCI     = 62
+	DECI     = 63
+	READBLK  = 70
+	WRITEBLK = 71
+	BLKCNT   = 72
+	OPEN     = 80
+	READ     = 81
+	WRITE    = 82
+	CLOSE    = 83
+	LISTEN   = 90
+	ACCEPT   = 91
+	CONNECT  = 92
+	SEND     = 93
+	RECV     = 94
+	SYS      = 100
+	SPAWN    = 110
+	YIELD    = 111
+	JOIN     = 112
+	THREADID = 113
+	MSEND    = 120
+	MRECV    = 121
+	MSELF    = 122
+	CAS      = 130
+	FETCHADD = 131
+	FENCE    = 132
+	COREID   = 133
+	HALT     = 0xFFFF
+	WD       = 0
+	DS       = 0
+	WS       = 0
+)
+
+// Opcodes from ExtensionFirst to ExtensionLast are reserved for
+// instructions that host applications register at runtime
+const (
+	ExtensionFirst = 0x1000
+	ExtensionLast  = 0x1FFF
 )
 
 type Instruction struct {
@@ -54,38 +96,124 @@ type Instruction struct {
 }
 
 var opcodes map[string]Instruction = map[string]Instruction{
-	"invalid": {Pneumonic: "invalid", Opcode: 0, Param: NONE},
-	"push":    {Pneumonic: "push", Opcode: 1, Param: INT32},
-	"pop":     {Pneumonic: "pop", Opcode: 2, Param: NONE},
-	"add":     {Pneumonic: "add", Opcode: 3, Param: NONE},
-	"sub":     {Pneumonic: "sub", Opcode: 4, Param: NONE},
-	"mul":     {Pneumonic: "mul", Opcode: 5, Param: NONE},
-	"div":     {Pneumonic: "div", Opcode: 6, Param: NONE},
-	"dup":     {Pneumonic: "dup", Opcode: 7, Param: NONE},
-	"dec":     {Pneumonic: "dec", Opcode: 8, Param: NONE},
-	"inc":     {Pneumonic: "inc", Opcode: 9, Param: NONE},
-	"jmp":     {Pneumonic: "jmp", Opcode: 10, Param: INT32},
-	"jif":     {Pneumonic: "jif", Opcode: 11, Param: INT32},
-	"out":     {Pneumonic: "out", Opcode: 20, Param: NONE},
-	"in":      {Pneumonic: "in", Opcode: 21, Param: NONE},
-	"st":      {Pneumonic: "st", Opcode: 30, Param: INT32},
-	"ld":      {Pneumonic: "ld", Opcode: 31, Param: INT32},
-	"sti":     {Pneumonic: "sti", Opcode: 32, Param: INT32},
-	"ldi":     {Pneumonic: "ldi", Opcode: 33, Param: INT32},
-	"and":     {Pneumonic: "and", Opcode: 40, Param: NONE},
-	"or":      {Pneumonic: "or", Opcode: 41, Param: NONE},
-	"xor":     {Pneumonic: "xor", Opcode: 42, Param: NONE},
-	"iseq":    {Pneumonic: "iseq", Opcode: 50, Param: NONE},
-	"isgt":    {Pneumonic: "isgt", Opcode: 51, Param: NONE},
-	"isgte":   {Pneumonic: "isgte", Opcode: 52, Param: NONE},
-	"islt":    {Pneumonic: "islt", Opcode: 53, Param: NONE},
-	"islte":   {Pneumonic: "islte", Opcode: 54, Param: NONE},
-	"minc":    {Pneumonic: "minc", Opcode: 60, Param: INT32},
-	"mdec":    {Pneumonic: "mdec", Opcode: 61, Param: INT32},
-	"inci":    {Pneumonic: "inci", Opcode: 62, Param: NONE},
-	"deci":    {Pneumonic: "deci", Opcode: 63, Param: NONE},
-	"halt":    {Pneumonic: "halt", Opcode: 0xFFFF, Param: NONE},
-	"wd":      {Pneumonic: "wd", Opcode: 0, Param: INT32, Dataop: true},
+	"invalid":  {Pneumonic: "invalid", Opcode: 0, Param: NONE},
+	"push":     {Pneumonic: "push", Opcode: 1, Param: INT32},
+	"pop":      {Pneumonic: "pop", Opcode: 2, Param: NONE},
+	"add":      {Pneumonic: "add", Opcode: 3, Param: NONE},
+	"sub":      {Pneumonic: "sub", Opcode: 4, Param: NONE},
+	"mul":      {Pneumonic: "mul", Opcode: 5, Param: NONE},
+	"div":      {Pneumonic: "div", Opcode: 6, Param: NONE},
+	"dup":      {Pneumonic: "dup", Opcode: 7, Param: NONE},
+	"dec":      {Pneumonic: "dec", Opcode: 8, Param: NONE},
+	"inc":      {Pneumonic: "inc", Opcode: 9, Param: NONE},
+	"jmp":      {Pneumonic: "jmp", Opcode: 10, Param: INT32},
+	"jif":      {Pneumonic: "jif", Opcode: 11, Param: INT32},
+	"out":      {Pneumonic: "out", Opcode: 20, Param: NONE},
+	"in":       {Pneumonic: "in", Opcode: 21, Param: NONE},
+	"outs":     {Pneumonic: "outs", Opcode: 22, Param: INT32},
+	"printf":   {Pneumonic: "printf", Opcode: 23, Param: INT32},
+	"eof":      {Pneumonic: "eof", Opcode: 24, Param: NONE},
+	"argc":     {Pneumonic: "argc", Opcode: 25, Param: NONE},
+	"argv":     {Pneumonic: "argv", Opcode: 26, Param: INT32},
+	"envc":     {Pneumonic: "envc", Opcode: 27, Param: NONE},
+	"envv":     {Pneumonic: "envv", Opcode: 28, Param: INT32},
+	"st":       {Pneumonic: "st", Opcode: 30, Param: INT32},
+	"ld":       {Pneumonic: "ld", Opcode: 31, Param: INT32},
+	"sti":      {Pneumonic: "sti", Opcode: 32, Param: INT32},
+	"ldi":      {Pneumonic: "ldi", Opcode: 33, Param: INT32},
+	"and":      {Pneumonic: "and", Opcode: 40, Param: NONE},
+	"or":       {Pneumonic: "or", Opcode: 41, Param: NONE},
+	"xor":      {Pneumonic: "xor", Opcode: 42, Param: NONE},
+	"iseq":     {Pneumonic: "iseq", Opcode: 50, Param: NONE},
+	"isgt":     {Pneumonic: "isgt", Opcode: 51, Param: NONE},
+	"isgte":    {Pneumonic: "isgte", Opcode: 52, Param: NONE},
+	"islt":     {Pneumonic: "islt", Opcode: 53, Param: NONE},
+	"islte":    {Pneumonic: "islte", Opcode: 54, Param: NONE},
+	"minc":     {Pneumonic: "minc", Opcode: 60, Param: INT32},
+	"mdec":     {Pneumonic: "mdec", Opcode: 61, Param: INT32},
+	"inci":     {Pneumonic: "inci", Opcode: 62, Param: NONE},
+	"deci":     {Pneumonic: "deci", Opcode: 63, Param: NONE},
+	"readblk":  {Pneumonic: "readblk", Opcode: 70, Param: INT32},
+	"writeblk": {Pneumonic: "writeblk", Opcode: 71, Param: INT32},
+	"blkcnt":   {Pneumonic: "blkcnt", Opcode: 72, Param: NONE},
+	"open":     {Pneumonic: "open", Opcode: 80, Param: INT32},
+	"read":     {Pneumonic: "read", Opcode: 81, Param: INT32},
+	"write":    {Pneumonic: "write", Opcode: 82, Param: INT32},
+	"close":    {Pneumonic: "close", Opcode: 83, Param: NONE},
+	"listen":   {Pneumonic: "listen", Opcode: 90, Param: INT32},
+	"accept":   {Pneumonic: "accept", Opcode: 91, Param: NONE},
+	"connect":  {Pneumonic: "connect", Opcode: 92, Param: INT32},
+	"send":     {Pneumonic: "send", Opcode: 93, Param: INT32},
+	"recv":     {Pneumonic: "recv", Opcode: 94, Param: INT32},
+	"sys":      {Pneumonic: "sys", Opcode: 100, Param: INT32},
+	"spawn":    {Pneumonic: "spawn", Opcode: 110, Param: INT32},
+	"yield":    {Pneumonic: "yield", Opcode: 111, Param: NONE},
+	"join":     {Pneumonic: "join", Opcode: 112, Param: NONE},
+	"threadid": {Pneumonic: "threadid", Opcode: 113, Param: NONE},
+	"msend":    {Pneumonic: "msend", Opcode: 120, Param: INT32},
+	"mrecv":    {Pneumonic: "mrecv", Opcode: 121, Param: INT32},
+	"mself":    {Pneumonic: "mself", Opcode: 122, Param: NONE},
+	"cas":      {Pneumonic: "cas", Opcode: 130, Param: INT32},
+	"fetchadd": {Pneumonic: "fetchadd", Opcode: 131, Param: INT32},
+	"fence":    {Pneumonic: "fence", Opcode: 132, Param: NONE},
+	"coreid":   {Pneumonic: "coreid", Opcode: 133, Param: NONE},
+	"halt":     {Pneumonic: "halt", Opcode: 0xFFFF, Param: NONE},
+	"wd":       {Pneumonic: "wd", Opcode: 0, Param: INT32, Dataop: true},
+	"ds":       {Pneumonic: "ds", Opcode: 0, Param: INT32, Dataop: true},
+	"ws":       {Pneumonic: "ws", Opcode: 0, Param: STRING, Dataop: true},
+}
+
+var extensionLock sync.RWMutex
+var extensions map[string]Instruction = map[string]Instruction{}
+
+// IsExtension reports whether opcode is in the range reserved for
+// extension instructions
+func IsExtension(opcode uint32) bool {
+	return opcode >= ExtensionFirst && opcode <= ExtensionLast
+}
+
+// RegisterExtension adds an instruction to the table used by the assembler
+// and disassembler. Its opcode must be in the extension range, and neither
+// the opcode nor the pneumonic can already be in use.
+func RegisterExtension(instr Instruction) error {
+	if !IsExtension(instr.Opcode) {
+		return errors.New(fmt.Sprintf("extension opcode %d outside reserved range %d-%d", instr.Opcode, ExtensionFirst, ExtensionLast))
+	} else if len(instr.Pneumonic) == 0 {
+		return errors.New("extension pneumonic required")
+	} else if instr.Dataop {
+		return errors.New(fmt.Sprintf("extension '%s' can't be a data operation", instr.Pneumonic))
+	}
+
+	if _, ok := opcodes[instr.Pneumonic]; ok {
+		return errors.New(fmt.Sprintf("pneumonic '%s' already defined", instr.Pneumonic))
+	}
+
+	extensionLock.Lock()
+	defer extensionLock.Unlock()
+
+	for k, v := range extensions {
+		if k == instr.Pneumonic {
+			return errors.New(fmt.Sprintf("pneumonic '%s' already defined", instr.Pneumonic))
+		} else if v.Opcode == instr.Opcode {
+			return errors.New(fmt.Sprintf("extension opcode %d already used by '%s'", instr.Opcode, k))
+		}
+	}
+
+	extensions[instr.Pneumonic] = instr
+	return nil
+}
+
+// UnregisterExtension removes the extension instruction using opcode, if
+// there is one, freeing both the opcode and its pneumonic
+func UnregisterExtension(opcode uint32) {
+	extensionLock.Lock()
+	defer extensionLock.Unlock()
+
+	for k, v := range extensions {
+		if v.Opcode == opcode {
+			delete(extensions, k)
+		}
+	}
 }
 
 func GetPneumonic(opcode uint32) string {
@@ -97,13 +225,27 @@ func GetPneumonic(opcode uint32) string {
 	return i.Pneumonic
 }
 
+// GetInstructionByOpcode looks up the instruction an opcode decodes to.
+// Data directives never appear in code, so they're skipped even though
+// they share opcode 0 with invalid.
 func GetInstructionByOpcode(opcode uint32) (*Instruction, error) {
 	for _, v := range opcodes {
-		if v.Opcode == uint32(opcode) {
+		if v.Opcode == uint32(opcode) && !v.Dataop {
 			return &v, nil
 		}
 	}
 
+	if IsExtension(opcode) {
+		extensionLock.RLock()
+		defer extensionLock.RUnlock()
+
+		for _, v := range extensions {
+			if v.Opcode == opcode {
+				return &v, nil
+			}
+		}
+	}
+
 	return nil, errors.New(fmt.Sprintf("unrecognized opcode %d", opcode))
 }
 
@@ -114,5 +256,12 @@ func GetInstructionByPneumonic(pneumonic string) (*Instruction, error) {
 		}
 	}
 
+	extensionLock.RLock()
+	defer extensionLock.RUnlock()
+
+	if v, ok := extensions[pneumonic]; ok {
+		return &v, nil
+	}
+
 	return nil, errors.New(fmt.Sprintf("unsupported operation '%s'", pneumonic))
 }
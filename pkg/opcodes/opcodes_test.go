@@ -0,0 +1,13 @@
+package opcodes
+
+import "testing"
+
+func TestDataDirectivesNotDecoded(t *testing.T) {
+	// the lookup goes through a map, so try enough times for any
+	// iteration order to show up
+	for i := 0; i < 100; i++ {
+		if p := GetPneumonic(0); p != "invalid" {
+			t.Fatalf("expected opcode 0 to decode as invalid, got %s", p)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Package replay records the values a program can't predict, and feeds
+// them back so that a run can be repeated exactly.
+//
+// A log is text, one value per line, giving where the value came from,
+// the instruction count when the program asked for it and the value:
+//
+//	# kabbit replay log v1
+//	in 3 42
+//	random 17 5
+//	in 30 eof
+//
+// Blank lines and lines starting with # are ignored.
+package replay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+)
+
+const header = "# kabbit replay log v1"
+
+// Entry is one recorded value
+type Entry struct {
+	Kind         cpu.ValueKind
+	Instructions int64
+	Value        int32
+	EOF          bool
+
+	// Line is where the entry is in the log, when it was read from one
+	Line int
+}
+
+func (e Entry) String() string {
+	value := strconv.Itoa(int(e.Value))
+	if e.EOF {
+		value = "eof"
+	}
+
+	return fmt.Sprintf("%s %d %s", e.Kind, e.Instructions, value)
+}
+
+// Recorder writes each value a program is given to a log
+type Recorder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	result := &Recorder{w: bufio.NewWriter(w)}
+	result.write(header)
+	return result
+}
+
+// Record is a cpu.NondeterminismFunc
+func (r *Recorder) Record(c *cpu.Cpu, kind cpu.ValueKind, read cpu.ReadValueFunc) (int32, bool, error) {
+	value, eof, err := read()
+	if err != nil {
+		return value, eof, err
+	}
+
+	r.write(Entry{Kind: kind, Instructions: c.Instructions(), Value: value, EOF: eof}.String())
+
+	return value, eof, nil
+}
+
+func (r *Recorder) write(line string) {
+	if r.err == nil {
+		_, r.err = fmt.Fprintln(r.w, line)
+	}
+}
+
+// Flush writes out anything buffered, returning the first error the
+// recorder had
+func (r *Recorder) Flush() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	return r.w.Flush()
+}
+
+// Replayer gives a program the values from a log instead of reading them
+type Replayer struct {
+	entries []Entry
+	next    int
+}
+
+// NewReplayer reads a whole log
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	result := &Replayer{}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		entry, err := parseEntry(text)
+		if err != nil {
+			return nil, fmt.Errorf("replay log line %d: %w", line, err)
+		}
+		entry.Line = line
+		result.entries = append(result.entries, entry)
+	}
+
+	return result, scanner.Err()
+}
+
+func parseEntry(text string) (Entry, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 3 {
+		return Entry{}, fmt.Errorf("expected kind, instruction count and value, found '%s'", text)
+	}
+
+	kind, ok := cpu.ParseValueKind(fields[0])
+	if !ok {
+		return Entry{}, fmt.Errorf("unknown kind '%s'", fields[0])
+	}
+	count, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Entry{}, fmt.Errorf("invalid instruction count '%s'", fields[1])
+	}
+
+	result := Entry{Kind: kind, Instructions: count}
+	if fields[2] == "eof" && kind == cpu.ValueInput {
+		result.EOF = true
+		return result, nil
+	}
+
+	value, err := strconv.ParseInt(fields[2], 10, 32)
+	if err != nil {
+		return Entry{}, fmt.Errorf("invalid value '%s'", fields[2])
+	}
+	result.Value = int32(value)
+
+	return result, nil
+}
+
+// Replay is a cpu.NondeterminismFunc. It fails with cpu.ErrDiverged if the
+// program asks for a different kind of value than the log has next, or
+// asks at a different instruction count.
+func (r *Replayer) Replay(c *cpu.Cpu, kind cpu.ValueKind, read cpu.ReadValueFunc) (int32, bool, error) {
+	if r.next >= len(r.entries) {
+		return 0, false, fmt.Errorf("%w: program asked for %s at instruction %d but the log has ended", cpu.ErrDiverged, kind, c.Instructions())
+	}
+
+	entry := r.entries[r.next]
+	if entry.Kind != kind || entry.Instructions != c.Instructions() {
+		return 0, false, fmt.Errorf("%w: program asked for %s at instruction %d but line %d of the log has %s at instruction %d",
+			cpu.ErrDiverged, kind, c.Instructions(), entry.Line, entry.Kind, entry.Instructions)
+	}
+	r.next++
+
+	return entry.Value, entry.EOF, nil
+}
+
+// Check is called once the program has finished, and fails if any of the
+// log wasn't used
+func (r *Replayer) Check(c *cpu.Cpu) error {
+	if r.next < len(r.entries) {
+		entry := r.entries[r.next]
+		return fmt.Errorf("%w: program stopped at instruction %d but line %d of the log has %s at instruction %d",
+			cpu.ErrDiverged, c.Instructions(), entry.Line, entry.Kind, entry.Instructions)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hculpan/kabbit/internal/vmtest"
+	"github.com/hculpan/kabbit/pkg/cpu"
+)
+
+const guessSource = `
+.requires console, sys
+        in
+        push 1000
+        sys random
+        add
+        out
+        in
+        out
+        halt
+`
+
+func TestRecordReplay(t *testing.T) {
+	ef := vmtest.Assemble(t, guessSource, cpu.StandardSyscalls())
+
+	log := new(bytes.Buffer)
+	recorder := NewRecorder(log)
+	c, recorded := vmtest.NewCpu(t, ef, "5\n")
+	c.SetNondeterminism(recorder.Record)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "in 6 eof") {
+		t.Fatalf("expected the end of input to be logged, got:\n%s", log.String())
+	}
+
+	// replaying needs no input and gives the same random number
+	replayer, err := NewReplayer(strings.NewReader(log.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, replayed := vmtest.NewCpu(t, ef, "")
+	c.SetNondeterminism(replayer.Replay)
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := replayer.Check(c); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.String() != recorded.String() {
+		t.Fatalf("expected %q, got %q", recorded.String(), replayed.String())
+	}
+
+	// a log recorded against other code diverges
+	replayer, err = NewReplayer(strings.NewReader(strings.Replace(log.String(), "random 3", "random 4", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ = vmtest.NewCpu(t, ef, "")
+	c.SetNondeterminism(replayer.Replay)
+	err = c.Run()
+	var fault *cpu.Fault
+	if !errors.As(err, &fault) || !errors.Is(err, cpu.ErrDiverged) || fault.IP != 4 {
+		t.Fatalf("expected divergence at the random syscall, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirFS confines file access to a single directory on the host
+type DirFS struct {
+	root string
+}
+
+// NewDirFS returns a file system rooted at dir, which must exist
+func NewDirFS(dir string) (*DirFS, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
+	}
+
+	return &DirFS{root: root}, nil
+}
+
+func (d *DirFS) OpenFile(name string, flag int) (File, error) {
+	fullPath, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(fullPath)
+	if err == nil && info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+
+	f, err := os.OpenFile(fullPath, flag, 0644)
+	if err != nil {
+		// don't leak host paths back to the caller
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: pathErr.Err}
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// resolve maps name onto the host file system, following any symlinks
+// and refusing paths that end up outside the root
+func (d *DirFS) resolve(name string) (string, error) {
+	cleaned, err := cleanPath("open", name)
+	if err != nil {
+		return "", err
+	}
+
+	fullPath := filepath.Join(d.root, filepath.FromSlash(cleaned))
+	resolved, err := filepath.EvalSymlinks(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// a dangling symlink would be followed when the file is created, and
+		// where it leads can't be checked, so refuse it outright
+		if info, err := os.Lstat(fullPath); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+
+		// the file may be about to be created, so check its directory instead
+		dir, err := filepath.EvalSymlinks(filepath.Dir(fullPath))
+		if err != nil {
+			return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		resolved = filepath.Join(dir, filepath.Base(fullPath))
+	} else if err != nil {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if resolved != d.root && !strings.HasPrefix(resolved, d.root+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+
+	return resolved, nil
+}
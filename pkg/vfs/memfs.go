@@ -0,0 +1,158 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// MemFS is a flat, in-memory file system, mostly useful for tests
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	data     []byte
+	readOnly bool
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memFile),
+	}
+}
+
+// WriteFile creates or replaces a file. A file created without write
+// permission in perm can't be opened for writing.
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	cleaned, err := cleanPath("write", name)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[cleaned] = &memFile{
+		data:     append([]byte{}, data...),
+		readOnly: perm&0200 == 0,
+	}
+
+	return nil
+}
+
+// ReadFile returns a copy of the contents of a file
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	cleaned, err := cleanPath("read", name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[cleaned]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return append([]byte{}, f.data...), nil
+}
+
+func (m *MemFS) OpenFile(name string, flag int) (File, error) {
+	cleaned, err := cleanPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	f, ok := m.files[cleaned]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		f = &memFile{}
+		m.files[cleaned] = f
+	} else if writable && f.readOnly {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+
+	if flag&os.O_TRUNC != 0 && writable {
+		f.data = nil
+	}
+
+	handle := &memHandle{fs: m, file: f, flag: flag}
+	if flag&os.O_APPEND != 0 {
+		handle.offset = len(f.data)
+	}
+
+	return handle, nil
+}
+
+// memHandle is an open MemFS file with its own offset
+type memHandle struct {
+	fs     *MemFS
+	file   *memFile
+	flag   int
+	offset int
+	closed bool
+}
+
+func (h *memHandle) Read(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if h.closed {
+		return 0, fs.ErrClosed
+	} else if h.flag&os.O_WRONLY != 0 {
+		return 0, fs.ErrPermission
+	}
+
+	if h.offset >= len(h.file.data) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, h.file.data[h.offset:])
+	h.offset += n
+	return n, nil
+}
+
+func (h *memHandle) Write(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if h.closed {
+		return 0, fs.ErrClosed
+	} else if h.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, fs.ErrPermission
+	}
+
+	if h.flag&os.O_APPEND != 0 {
+		h.offset = len(h.file.data)
+	}
+
+	end := h.offset + len(p)
+	if end > len(h.file.data) {
+		h.file.data = append(h.file.data, make([]byte, end-len(h.file.data))...)
+	}
+	copy(h.file.data[h.offset:], p)
+	h.offset = end
+
+	return len(p), nil
+}
+
+func (h *memHandle) Close() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if h.closed {
+		return fs.ErrClosed
+	}
+	h.closed = true
+	return nil
+}
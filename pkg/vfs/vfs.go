@@ -0,0 +1,30 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+)
+
+// File is an open file handed out by a FileSystem
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// FileSystem is the storage behind the VM's file instructions. Names are
+// always slash separated and relative to the root of the file system.
+type FileSystem interface {
+	OpenFile(name string, flag int) (File, error)
+}
+
+// cleanPath turns a program supplied name into a rooted, cleaned path so
+// that ".." can never climb above the root
+func cleanPath(op, name string) (string, error) {
+	if len(name) == 0 {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return path.Clean("/" + name), nil
+}
@@ -0,0 +1,104 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirFSConfinedToRoot(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(parent, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(parent, "secret.txt"), filepath.Join(root, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := NewDirFS(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ".." is cleaned away, so this looks for secret.txt inside the root
+	if _, err := fsys.OpenFile("../secret.txt", os.O_RDONLY); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if _, err := fsys.OpenFile("link.txt", os.O_RDONLY); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected permission denied for symlink out of root, got %v", err)
+	}
+
+	f, err := fsys.OpenFile("/sub/../new.txt", os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	f.Close()
+	if _, err := os.Stat(filepath.Join(root, "new.txt")); err != nil {
+		t.Fatalf("expected file in root: %v", err)
+	}
+}
+
+func TestDirFSDanglingSymlink(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(parent, "outside.txt")
+	if err := os.Symlink(outside, filepath.Join(root, "dangling.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := NewDirFS(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fsys.OpenFile("dangling.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected permission denied for dangling symlink, got %v", err)
+	}
+	if _, err := os.Lstat(outside); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected no file created outside the root, got %v", err)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	fsys := NewMemFS()
+	fsys.WriteFile("readonly.txt", []byte("fixed"), 0444)
+
+	if _, err := fsys.OpenFile("missing.txt", os.O_RDONLY); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if _, err := fsys.OpenFile("readonly.txt", os.O_WRONLY); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	f, err := fsys.OpenFile("log.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello "))
+	f.Write([]byte("world"))
+	f.Close()
+
+	f, err = fsys.OpenFile("log.txt", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world" {
+		t.Fatalf("expected %q, got %q", "hello world", string(data))
+	}
+}
@@ -0,0 +1,252 @@
+package kabbit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hculpan/kabbit/pkg/cpu"
+)
+
+// ErrPoolClosed is returned for jobs submitted after Close
+var ErrPoolClosed = errors.New("pool closed")
+
+// Pool runs programs on a fixed number of workers. It's meant for
+// services that run many small programs: executables loaded through
+// Program are parsed once and shared, and each worker keeps its stack
+// from one job to the next rather than allocating a new one. Every job
+// gets its own options, so input, output and limits aren't shared.
+//
+// A Pool is safe to use from any number of goroutines.
+type Pool struct {
+	queue chan *Job
+	wg    sync.WaitGroup
+
+	// mu guards closed, and is held for reading while a job is queued so
+	// that Close can't close the queue under Submit
+	mu     sync.RWMutex
+	closed bool
+
+	cacheMu  sync.Mutex
+	programs map[string]*cachedProgram
+
+	metricsMu sync.Mutex
+	started   time.Time
+	jobs      int64
+	failed    int64
+	failures  map[string]int64
+	instrs    int64
+	busy      time.Duration
+}
+
+type cachedProgram struct {
+	modTime time.Time
+	size    int64
+	prog    *Program
+}
+
+// Job is a program waiting for, or finished with, a worker
+type Job struct {
+	prog    *Program
+	options []Option
+	done    chan struct{}
+	result  *Result
+	err     error
+}
+
+// Metrics is a snapshot of what a pool has done since it was created
+type Metrics struct {
+	Jobs   int64
+	Failed int64
+
+	// Failures counts failed jobs by why they failed: the fault kind
+	// (e.g. "divide by zero"), the limit that was hit, "interrupted", or
+	// "error" if the program couldn't be started
+	Failures map[string]int64
+
+	Instructions int64
+
+	// Busy is the time spent running jobs, summed over all workers, and
+	// Elapsed the time since the pool was created
+	Busy    time.Duration
+	Elapsed time.Duration
+
+	JobsPerSecond         float64
+	InstructionsPerSecond float64
+}
+
+// NewPool starts a pool with the given number of workers, at least one
+func NewPool(workers int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	result := &Pool{
+		queue:    make(chan *Job, workers),
+		programs: map[string]*cachedProgram{},
+		started:  time.Now(),
+		failures: map[string]int64{},
+	}
+
+	result.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go result.worker()
+	}
+
+	return result
+}
+
+// Program loads an executable (.kbx) file, reusing the copy loaded
+// earlier unless the file has changed since
+func (p *Pool) Program(filename string) (*Program, error) {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p.cacheMu.Lock()
+	cached, ok := p.programs[path]
+	p.cacheMu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.prog, nil
+	}
+
+	prog, err := LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p.cacheMu.Lock()
+	p.programs[path] = &cachedProgram{modTime: info.ModTime(), size: info.Size(), prog: prog}
+	p.cacheMu.Unlock()
+
+	return prog, nil
+}
+
+// Submit queues prog to be run with options, waiting if every worker is
+// busy and the queue is full
+func (p *Pool) Submit(prog *Program, options ...Option) *Job {
+	job := &Job{prog: prog, options: options, done: make(chan struct{})}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		job.err = ErrPoolClosed
+		close(job.done)
+		return job
+	}
+
+	p.queue <- job
+	return job
+}
+
+// Run is Submit followed by Wait
+func (p *Pool) Run(prog *Program, options ...Option) (*Result, error) {
+	return p.Submit(prog, options...).Wait()
+}
+
+// Close stops the pool taking new jobs and waits for the queued ones to
+// finish
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// Metrics returns the pool's totals so far
+func (p *Pool) Metrics() Metrics {
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+
+	result := Metrics{
+		Jobs:         p.jobs,
+		Failed:       p.failed,
+		Failures:     make(map[string]int64, len(p.failures)),
+		Instructions: p.instrs,
+		Busy:         p.busy,
+		Elapsed:      time.Since(p.started),
+	}
+	for kind, count := range p.failures {
+		result.Failures[kind] = count
+	}
+	if seconds := result.Elapsed.Seconds(); seconds > 0 {
+		result.JobsPerSecond = float64(result.Jobs) / seconds
+		result.InstructionsPerSecond = float64(result.Instructions) / seconds
+	}
+
+	return result
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+
+	var stack []int32
+	for job := range p.queue {
+		var used []int32
+		job.result, used, job.err = job.prog.run(stack, job.options)
+		if len(used) > len(stack) {
+			stack = used
+		}
+		p.record(job.result, job.err)
+		close(job.done)
+	}
+}
+
+func (p *Pool) record(result *Result, err error) {
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+
+	p.jobs++
+	if result != nil {
+		p.instrs += result.Instructions
+		p.busy += result.Duration
+	}
+	if err != nil {
+		p.failed++
+		p.failures[failureKind(result, err)]++
+	}
+}
+
+// failureKind names the reason a job failed, for Metrics
+func failureKind(result *Result, err error) string {
+	if result == nil {
+		return "error"
+	}
+
+	var limitErr *cpu.LimitError
+	var fault *cpu.Fault
+	switch {
+	case result.Status == LimitExceeded && errors.As(err, &limitErr):
+		return limitErr.Kind.Error()
+	case result.Status == Interrupted:
+		return "interrupted"
+	case errors.As(err, &fault):
+		return fault.Kind.Error()
+	default:
+		return "error"
+	}
+}
+
+// Wait blocks until the job has run and returns what Program.Run would
+// have
+func (j *Job) Wait() (*Result, error) {
+	<-j.done
+	return j.result, j.err
+}
+
+// Done is closed once the job has run
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}